@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 访问规则, 限制库的根目录或子目录只有指定的用户或组可以访问
+// 没有规则的目录所有登录的用户都可以访问, 有多个规则时使用最深的那个
+type AccessRule struct {
+	Path   string   `json:"path"`
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
+// PIN 的最小长度
+const minPinLen = 4
+
+// PIN 连续错误 maxPinFailures 次后锁定 pinLockout, 之后每错一次锁定时间加倍, 最长 maxPinLockout
+const (
+	maxPinFailures = 5
+	pinLockout     = time.Minute
+	maxPinLockout  = time.Hour
+)
+
+// 错误记录超过这个数量时清理没有锁定的记录, 登录时的用户名可以随便输入, 不清理会一直增加
+const maxFailureEntries = 10000
+
+// 每个用户输入 PIN 连续错误的次数, 登录密码也使用, 只在内存中, 重启后清零
+type pinLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*pinFailure
+}
+
+type pinFailure struct {
+	count int
+	// 锁定到这个时间
+	until time.Time
+}
+
+var pinFailures = newPinLimiter()
+
+func newPinLimiter() *pinLimiter {
+	return &pinLimiter{failures: map[string]*pinFailure{}}
+}
+
+// 用户还需要等待多久才能再输入 PIN, 没有锁定返回 0
+func (l *pinLimiter) Wait(user string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.failures[user]; ok && now.Before(f.until) {
+		return f.until.Sub(now)
+	}
+	return 0
+}
+
+// 记录一次错误, 返回连续错误的次数
+func (l *pinLimiter) Fail(user string, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[user]
+	if !ok {
+		if len(l.failures) >= maxFailureEntries {
+			for k, v := range l.failures {
+				if !now.Before(v.until) {
+					delete(l.failures, k)
+				}
+			}
+		}
+		f = &pinFailure{}
+		l.failures[user] = f
+	}
+	f.count++
+	if f.count >= maxPinFailures {
+		lockout := maxPinLockout
+		if n := f.count - maxPinFailures; n < 6 {
+			if d := pinLockout << uint(n); d < lockout {
+				lockout = d
+			}
+		}
+		f.until = now.Add(lockout)
+	}
+	return f.count
+}
+
+// 输入正确后清除错误记录
+func (l *pinLimiter) Reset(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, user)
+}
+
+// 所有访问规则
+func (s *userStore) AccessRules() []*AccessRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rules := make([]*AccessRule, len(s.Rules))
+	copy(rules, s.Rules)
+	return rules
+}
+
+// 替换所有访问规则
+func (s *userStore) SetAccessRules(rules []*AccessRule) error {
+	for _, rule := range rules {
+		if rule.Path == "" {
+			return NewError(ErrBadRequest, "规则的路径不能为空")
+		}
+		rule.Path = filepath.Clean(rule.Path)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rules = rules
+	return s.save()
+}
+
+// 设置隐藏库的 PIN
+func (s *userStore) SetHiddenPin(pin string) error {
+	if len(pin) < minPinLen {
+		return NewError(ErrBadRequest, "PIN 至少需要%d位", minPinLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.HiddenPin = string(hash)
+	return s.save()
+}
+
+// 验证隐藏库的 PIN
+func (s *userStore) CheckHiddenPin(pin string) bool {
+	s.mu.RLock()
+	hash := s.HiddenPin
+	s.mu.RUnlock()
+	return hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pin)) == nil
+}
+
+// 用户是否可以访问路径, 路径必须在某个库中
+// 隐藏的库需要会话已经解锁, 管理员也一样, 避免误展示
+func (s *userStore) CanAccess(u *UserInfo, unlocked bool, libs []*Library, p string) bool {
+	if u == nil {
+		return false
+	}
+	lib := FindLibrary(libs, p)
+	if lib == nil || (lib.Hidden && !unlocked) {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rule *AccessRule
+	for _, r := range s.Rules {
+		if isWithin(r.Path, p) && (rule == nil || len(r.Path) > len(rule.Path)) {
+			rule = r
+		}
+	}
+	if rule == nil {
+		return true
+	}
+	for _, name := range rule.Users {
+		if name == u.Name {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		for _, ug := range u.Groups {
+			if g == ug {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 请求的会话是否已经解锁隐藏的库
+func isUnlocked(r *http.Request) bool {
+	unlocked, _ := r.Context().Value(unlockedKey).(bool)
+	return unlocked
+}
+
+// 记录会话的解锁状态
+func withUnlocked(r *http.Request) *http.Request {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), unlockedKey, users.SessionUnlocked(c.Value)))
+}
+
+// 当前用户是否可以访问路径
+func canAccess(r *http.Request, p string) bool {
+	return users.CanAccess(CurrentUser(r), isUnlocked(r), conf.Libraries, p)
+}
+
+// 当前用户可以访问的视频, 没有权限和不存在一样, 不暴露视频是否存在
+func accessibleVideo(w http.ResponseWriter, r *http.Request) *Video {
+	v := VideoByID(mux.Vars(r)["id"])
+	if v == nil || !canAccess(r, v.Path) {
+		WriteError(w, r, NewError(ErrNotFound, "视频不存在"))
+		return nil
+	}
+	return v
+}
+
+// 过滤出当前用户可以访问的视频
+func accessibleVideos(r *http.Request, videos []*Video) []*Video {
+	res := make([]*Video, 0, len(videos))
+	for _, v := range videos {
+		if canAccess(r, v.Path) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// 文件所属的视频, 视频文件本身或者视频的预览文件, 都不是返回 nil
+func contentVideo(p string) *Video {
+	p = filepath.Clean(p)
+	for _, v := range Videos() {
+		if v.Path == p {
+			return v
+		}
+		if v.Preview != nil && strings.HasPrefix(p, filepath.Dir(v.Preview.Cover)+string(filepath.Separator)) {
+			return v
+		}
+	}
+	return nil
+}
+
+// 获取所有访问规则
+func GetAccessRules(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, users.AccessRules())
+}
+
+// 替换所有访问规则
+func SetAccessRules(w http.ResponseWriter, r *http.Request) {
+	var rules []*AccessRule
+	if err := readJson(r, &rules); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	if err := users.SetAccessRules(rules); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, rules)
+}
+
+// 设置用户的组
+func SetUserGroups(w http.ResponseWriter, r *http.Request) {
+	var groups []string
+	if err := readJson(r, &groups); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	if err := users.SetGroups(mux.Vars(r)["name"], groups); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, groups)
+}
+
+// 设置隐藏库的 PIN
+func SetHiddenPin(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Pin string `json:"pin"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	if err := users.SetHiddenPin(req.Pin); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 输入 PIN 解锁隐藏的库, 只对当前会话有效
+// 按用户记录连续错误的次数, 太多时锁定一段时间, 重新登录也不能绕过
+func UnlockHidden(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Pin string `json:"pin"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "只有登录的会话可以解锁"))
+		return
+	}
+	name := CurrentUser(r).Name
+	now := time.Now()
+	if wait := pinFailures.Wait(name, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		WriteError(w, r, NewError(ErrTooManyRequests, "PIN 错误次数太多"))
+		return
+	}
+	if !users.CheckHiddenPin(req.Pin) {
+		n := pinFailures.Fail(name, now)
+		log.Printf("用户 %v 解锁隐藏的库失败, PIN 错误, 连续%d次, 来自 %v", name, n, r.RemoteAddr)
+		WriteError(w, r, NewError(ErrForbidden, "PIN 错误"))
+		return
+	}
+	pinFailures.Reset(name)
+	if err := users.SetSessionUnlocked(c.Value, true); err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "解锁失败"))
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 重新锁定隐藏的库
+func LockHidden(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := users.SetSessionUnlocked(c.Value, false); err != nil {
+			log.Printf("锁定失败: %+v", err)
+		}
+	}
+	OkCode(w, nil)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCanAccess(t *testing.T) {
+	s := newUserStore("")
+	s.Rules = []*AccessRule{
+		{Path: "/media/movies/kids", Users: []string{"bob"}, Groups: []string{"family"}},
+		{Path: "/media/movies/kids/cartoons"},
+		{Path: "/media/private", Users: []string{"alice"}},
+	}
+	libs := []*Library{{Dir: "/media/movies"}, {Dir: "/media/private"}, {Dir: "/media/secret", Hidden: true}}
+
+	admin := &UserInfo{Name: "root", Admin: true}
+	alice := &UserInfo{Name: "alice"}
+	bob := &UserInfo{Name: "bob"}
+	carol := &UserInfo{Name: "carol", Groups: []string{"family"}}
+
+	tests := []struct {
+		name     string
+		user     *UserInfo
+		unlocked bool
+		path     string
+		want     bool
+	}{
+		{"没有登录", nil, false, "/media/movies/a.mp4", false},
+		{"没有规则", alice, false, "/media/movies/a.mp4", true},
+		{"不在库中", admin, false, "/etc/passwd", false},
+		{"用户规则", bob, false, "/media/movies/kids/a.mp4", true},
+		{"组规则", carol, false, "/media/movies/kids/a.mp4", true},
+		{"没有权限", alice, false, "/media/movies/kids/a.mp4", false},
+		{"最深的规则优先", bob, false, "/media/movies/kids/cartoons/a.mp4", false},
+		{"管理员不受规则限制", admin, false, "/media/private/a.mp4", true},
+		{"库的根目录", bob, false, "/media/private", false},
+		{"隐藏的库没有解锁", admin, false, "/media/secret/a.mp4", false},
+		{"隐藏的库已经解锁", alice, true, "/media/secret/a.mp4", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.CanAccess(tt.user, tt.unlocked, libs, tt.path); got != tt.want {
+				t.Errorf("CanAccess() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHiddenPin(t *testing.T) {
+	s := newUserStore("")
+	if s.CheckHiddenPin("") {
+		t.Errorf("CheckHiddenPin() 没有设置 PIN 时应该失败")
+	}
+	if err := s.SetHiddenPin("12"); err == nil {
+		t.Errorf("SetHiddenPin() PIN 太短应该返回错误")
+	}
+	if err := s.SetHiddenPin("2468"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !s.CheckHiddenPin("2468") || s.CheckHiddenPin("1357") {
+		t.Errorf("CheckHiddenPin() 结果错误")
+	}
+
+	if _, err := s.Create("alice", "password1", false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	token, _, _ := s.NewSession("alice")
+	if err := s.SetSessionUnlocked(token, true); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !s.SessionUnlocked(token) {
+		t.Errorf("SessionUnlocked() = false, want true")
+	}
+}
+
+func TestPinLimiter(t *testing.T) {
+	l := newPinLimiter()
+	now := time.Now()
+	for i := 1; i < maxPinFailures; i++ {
+		l.Fail("alice", now)
+	}
+	if wait := l.Wait("alice", now); wait != 0 {
+		t.Errorf("Wait() 次数没有用完 = %v", wait)
+	}
+	if n := l.Fail("alice", now); n != maxPinFailures {
+		t.Errorf("Fail() = %v, want %v", n, maxPinFailures)
+	}
+	if wait := l.Wait("alice", now); wait != pinLockout {
+		t.Errorf("Wait() = %v, want %v", wait, pinLockout)
+	}
+	if wait := l.Wait("bob", now); wait != 0 {
+		t.Errorf("Wait() 其他用户不受影响 = %v", wait)
+	}
+
+	// 锁定后再错, 锁定时间加倍, 不超过最长时间
+	now = now.Add(pinLockout)
+	l.Fail("alice", now)
+	if wait := l.Wait("alice", now); wait != 2*pinLockout {
+		t.Errorf("Wait() 再错一次 = %v, want %v", wait, 2*pinLockout)
+	}
+	for i := 0; i < 10; i++ {
+		l.Fail("alice", now)
+	}
+	if wait := l.Wait("alice", now); wait != maxPinLockout {
+		t.Errorf("Wait() 最长 = %v, want %v", wait, maxPinLockout)
+	}
+
+	l.Reset("alice")
+	if wait := l.Wait("alice", now); wait != 0 {
+		t.Errorf("Wait() 清除后 = %v", wait)
+	}
+}
+
+func TestPinLimiterEntries(t *testing.T) {
+	l := newPinLimiter()
+	now := time.Now()
+	for i := 0; i < maxPinFailures; i++ {
+		l.Fail("locked", now)
+	}
+	for i := 0; len(l.failures) < maxFailureEntries; i++ {
+		l.Fail(strconv.Itoa(i), now)
+	}
+	// 记录太多时清理没有锁定的, 锁定的保留
+	l.Fail("new", now)
+	if len(l.failures) != 2 {
+		t.Errorf("清理后还有 %v 个记录, want 2", len(l.failures))
+	}
+	if wait := l.Wait("locked", now); wait != pinLockout {
+		t.Errorf("Wait() 锁定的记录应该保留 = %v", wait)
+	}
+}
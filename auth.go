@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 会话 cookie 的名字
+const sessionCookie = "night_session"
+
+type contextKey int
+
+const (
+	// 当前用户
+	userKey contextKey = iota
+	// 会话是否已经解锁隐藏的库
+	unlockedKey
+)
+
+// 登录密码连续错误的次数, 按用户名和来源地址计数, 锁定规则和 PIN 一样
+var loginFailures = newPinLimiter()
+
+// 登录错误计数的 key, 其他地址的错误不会锁定这个用户
+func loginKey(r *http.Request, name string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return name + "|" + host
+}
+
+// 不需要登录的路径
+func isPublicPath(p string) bool {
+	return p == "/" || p == "/login" || p == "/web" || strings.HasPrefix(p, "/web/") || strings.HasPrefix(p, "/share/")
+}
+
+// 请求的用户, 优先使用 bearer token, 然后是会话 cookie
+func requestUser(r *http.Request) (UserInfo, bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return users.TokenUser(strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return users.SessionUser(c.Value)
+	}
+	return UserInfo{}, false
+}
+
+// 当前登录的用户, 没有登录返回 nil
+func CurrentUser(r *http.Request) *UserInfo {
+	u, _ := r.Context().Value(userKey).(*UserInfo)
+	return u
+}
+
+// 认证中间件, 除了登录和网页, 其他的请求都需要登录
+func auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := requestUser(r); ok {
+			r = withUnlocked(r.WithContext(context.WithValue(r.Context(), userKey, &u)))
+		} else if u, unlocked, ok := streamTokenUser(r); ok {
+			// 外部播放器使用播放列表中签名的链接, 解锁状态也来自签名
+			ctx := context.WithValue(r.Context(), userKey, &u)
+			r = r.WithContext(context.WithValue(ctx, unlockedKey, unlocked))
+		} else if !isPublicPath(r.URL.Path) {
+			WriteError(w, r, NewError(ErrUnauthorized, "请先登录"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 只有管理员可以访问
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := CurrentUser(r); u == nil || !u.Admin {
+			WriteError(w, r, NewError(ErrForbidden, "需要管理员权限"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// 解析 json 请求
+func readJson(r *http.Request, v interface{}) error {
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// 登录, 成功后设置会话 cookie
+func Login(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	key := loginKey(r, req.Name)
+	now := time.Now()
+	if wait := loginFailures.Wait(key, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		WriteError(w, r, NewError(ErrTooManyRequests, "登录失败次数太多"))
+		return
+	}
+	u, ok := users.Authenticate(req.Name, req.Password)
+	if !ok {
+		n := loginFailures.Fail(key, now)
+		log.Printf("用户 %v 登录失败, 连续%d次, 来自 %v", req.Name, n, r.RemoteAddr)
+		WriteError(w, r, NewError(ErrUnauthorized, "用户名或密码错误"))
+		return
+	}
+	loginFailures.Reset(key)
+	token, session, err := users.NewSession(u.Name)
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "登录失败"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(csrfHeader, csrfToken(token))
+	OkCode(w, u)
+}
+
+// 退出登录, 删除会话和 cookie
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := users.DeleteSession(c.Value); err != nil {
+			log.Printf("删除会话失败: %+v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	OkCode(w, nil)
+}
+
+// 获取当前用户
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	setCSRFHeader(w, r)
+	OkCode(w, CurrentUser(r))
+}
+
+// 获取所有用户
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, users.All())
+}
+
+// 创建用户
+func AddUser(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Admin    bool   `json:"admin"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	u, err := users.Create(req.Name, req.Password, req.Admin)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, u)
+}
+
+// 删除用户, 不能删除自己
+func RemoveUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == CurrentUser(r).Name {
+		WriteError(w, r, NewError(ErrBadRequest, "不能删除自己"))
+		return
+	}
+	if err := users.Delete(name); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if err := history.DeleteUser(name); err != nil {
+		log.Printf("删除观看记录失败: %+v", err)
+	}
+	if err := organize.DeleteUser(name); err != nil {
+		log.Printf("删除收藏失败: %+v", err)
+	}
+	if err := smartLists.DeleteUser(name); err != nil {
+		log.Printf("删除播放列表失败: %+v", err)
+	}
+	if err := shares.DeleteUser(name); err != nil {
+		log.Printf("删除分享链接失败: %+v", err)
+	}
+	OkCode(w, nil)
+}
+
+// 修改密码, 修改自己的密码需要旧密码, 管理员可以直接修改其他用户的密码
+func SetUserPassword(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	req := struct {
+		Old      string `json:"old"`
+		Password string `json:"password"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	u := CurrentUser(r)
+	switch {
+	case u.Name == name:
+		if _, ok := users.Authenticate(name, req.Old); !ok {
+			WriteError(w, r, NewError(ErrForbidden, "旧密码错误"))
+			return
+		}
+	case !u.Admin:
+		WriteError(w, r, NewError(ErrForbidden, "需要管理员权限"))
+		return
+	}
+	if err := users.SetPassword(name, req.Password); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 获取当前用户的 api token
+func GetTokens(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, users.Tokens(CurrentUser(r).Name))
+}
+
+// 创建 api token, token 原文只返回这一次
+func AddToken(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	token, t, err := users.NewToken(CurrentUser(r).Name, req.Name)
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "创建 token 失败"))
+		return
+	}
+	OkCode(w, struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}{t.ID, t.Name, token})
+}
+
+// 删除 api token
+func RemoveToken(w http.ResponseWriter, r *http.Request) {
+	if err := users.DeleteToken(CurrentUser(r).Name, mux.Vars(r)["tid"]); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
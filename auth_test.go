@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	old := users
+	defer func() { users = old }()
+	users = newUserStore("")
+	if _, err := users.Create("alice", "password1", false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	session, _, _ := users.NewSession("alice")
+	token, _, _ := users.NewToken("alice", "script")
+
+	h := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	admin := auth(adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		auth    func(r *http.Request)
+		want    int
+	}{
+		{"没有登录", h, "/resources", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"网页不需要登录", h, "/web/index.html", func(r *http.Request) {}, http.StatusNoContent},
+		{"登录不需要登录", h, "/login", func(r *http.Request) {}, http.StatusNoContent},
+		{"会话", h, "/resources", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		}, http.StatusNoContent},
+		{"错误的会话", h, "/resources", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "invalid"})
+		}, http.StatusUnauthorized},
+		{"token", h, "/resources", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}, http.StatusNoContent},
+		{"不是管理员", admin, "/users", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(GET, tt.path, nil)
+			tt.auth(r)
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	oldUsers, oldFailures := users, loginFailures
+	defer func() { users, loginFailures = oldUsers, oldFailures }()
+	users = newUserStore("")
+	loginFailures = newPinLimiter()
+	if _, err := users.Create("alice", "password1", false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	login := func(password, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(POST, "/login", strings.NewReader(`{"name":"alice","password":"`+password+`"}`))
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		Login(w, r)
+		return w
+	}
+
+	for i := 0; i < maxPinFailures; i++ {
+		if w := login("wrong", "10.0.0.1:1234"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("第%v次 status = %v, want %v", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	// 锁定后密码正确也不能登录
+	w := login("password1", "10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("锁定后 status = %v, Retry-After = %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// 其他地址不受影响, 登录成功后清除错误记录
+	if w := login("password1", "10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("其他地址 status = %v, want %v", w.Code, http.StatusOK)
+	}
+	for i := 1; i < maxPinFailures; i++ {
+		login("wrong", "10.0.0.3:1234")
+	}
+	login("password1", "10.0.0.3:1234")
+	for i := 1; i < maxPinFailures; i++ {
+		login("wrong", "10.0.0.3:1234")
+	}
+	if wait := loginFailures.Wait("alice|10.0.0.3", time.Now()); wait != 0 {
+		t.Errorf("登录成功后应该清除错误记录, Wait() = %v", wait)
+	}
+}
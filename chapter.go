@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 视频章节
+type Chapter struct {
+	ID    int           `json:"id"`
+	Title string        `json:"title"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
+	// 章节的缩略图
+	Thumb string `json:"thumb"`
+}
+
+// ffprobe -show_chapters 的输出
+type probeChapter struct {
+	ID        int    `json:"id"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Tags      struct {
+		Title string `json:"title"`
+	} `json:"tags"`
+}
+
+// 转换 ffprobe 的章节信息, 没有标题的使用序号
+func parseChapters(pcs []probeChapter) []*Chapter {
+	var chapters []*Chapter
+	for i, pc := range pcs {
+		start, err := strconv.ParseFloat(pc.StartTime, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseFloat(pc.EndTime, 64)
+		if err != nil {
+			continue
+		}
+		title := pc.Tags.Title
+		if title == "" {
+			title = fmt.Sprintf("%d", i+1)
+		}
+		chapters = append(chapters, &Chapter{
+			ID:    pc.ID,
+			Title: title,
+			Start: seconds(start),
+			End:   seconds(end),
+		})
+	}
+	return chapters
+}
+
+// 秒转换成时长, 精确到毫秒
+func seconds(s float64) time.Duration {
+	return time.Millisecond * time.Duration(s*1000)
+}
+
+// 章节缩略图的时间点, 章节开头经常是黑屏, 往后取一点
+func (c *Chapter) ThumbTime() time.Duration {
+	t := c.Start + (c.End-c.Start)/10
+	if t <= 0 {
+		t = time.Millisecond
+	}
+	return t
+}
+
+// 生成章节缩略图, 只解码关键帧, 每个章节取缩略图时间点之后的第一个关键帧
+func GenChapterThumbs(ctx context.Context, ffmpeg, path, outDir string, chapters []*Chapter, width, height int, toneMap string) error {
+	if len(chapters) <= 0 {
+		return nil
+	}
+
+	conds := make([]string, len(chapters))
+	for i, c := range chapters {
+		t := c.ThumbTime().Seconds()
+		conds[i] = fmt.Sprintf("gte(t,%.3f)*lt(prev_t,%.3f)", t, t)
+	}
+	vf := withToneMap("select='"+strings.Join(conds, "+")+"'", toneMap)
+
+	thumbs, times, err := videoThumbnailsFilter(ctx, ffmpeg, path, outDir, []string{"-skip_frame", "nokey"}, vf, width, height, "")
+	if err != nil {
+		return err
+	}
+	assignChapterThumbs(chapters, thumbs, times)
+	return nil
+}
+
+// 按缩略图的时间对应到章节, 缩略图属于时间点在它之前的最后一个章节
+// 没有关键帧的章节会和后面的章节共用一帧, 超出章节结束时间的不算, 对应不上的章节没有缩略图
+func assignChapterThumbs(chapters []*Chapter, thumbs []string, times []time.Duration) {
+	if len(times) != len(thumbs) {
+		return
+	}
+	for i, t := range times {
+		var c *Chapter
+		for _, ch := range chapters {
+			if ch.ThumbTime() <= t {
+				c = ch
+			}
+		}
+		if c != nil && t < c.End && c.Thumb == "" {
+			c.Thumb = thumbs[i]
+		}
+	}
+}
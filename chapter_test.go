@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChapters(t *testing.T) {
+	pcs := []probeChapter{
+		{ID: 0, StartTime: "0.000000", EndTime: "100.500000"},
+		{ID: 1, StartTime: "100.500000", EndTime: "200.000000"},
+		{ID: 2, StartTime: "bad", EndTime: "300.000000"},
+	}
+	pcs[1].Tags.Title = "第二章"
+
+	chapters := parseChapters(pcs)
+	if len(chapters) != 2 {
+		t.Fatalf("parseChapters() got %d chapters, want 2", len(chapters))
+	}
+	if c := chapters[0]; c.Title != "1" || c.Start != 0 || c.End != 100500*time.Millisecond {
+		t.Errorf("parseChapters() chapter 0 = %+v", c)
+	}
+	if c := chapters[1]; c.Title != "第二章" || c.ThumbTime() != 110450*time.Millisecond {
+		t.Errorf("parseChapters() chapter 1 = %+v, thumb time %v", c, c.ThumbTime())
+	}
+	if c := chapters[0]; c.ThumbTime() != 10050*time.Millisecond {
+		t.Errorf("ThumbTime() = %v", c.ThumbTime())
+	}
+}
+
+func TestAssignChapterThumbs(t *testing.T) {
+	newChapters := func() []*Chapter {
+		return []*Chapter{
+			{Start: 0, End: 100 * time.Second},
+			{Start: 100 * time.Second, End: 105 * time.Second},
+			{Start: 105 * time.Second, End: 200 * time.Second},
+		}
+	}
+	tests := []struct {
+		name   string
+		thumbs []string
+		times  []time.Duration
+		want   []string
+	}{
+		{"每个章节都有", []string{"1.jpg", "2.jpg", "3.jpg"}, []time.Duration{12 * time.Second, 101 * time.Second, 120 * time.Second}, []string{"1.jpg", "2.jpg", "3.jpg"}},
+		{"中间章节没有关键帧", []string{"1.jpg", "3.jpg"}, []time.Duration{12 * time.Second, 120 * time.Second}, []string{"1.jpg", "", "3.jpg"}},
+		{"关键帧超出章节", []string{"1.jpg", "3.jpg"}, []time.Duration{12 * time.Second, 106 * time.Second}, []string{"1.jpg", "", ""}},
+		{"没有时间", []string{"1.jpg", "2.jpg"}, nil, []string{"", "", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chapters := newChapters()
+			assignChapterThumbs(chapters, tt.thumbs, tt.times)
+			for i, c := range chapters {
+				if c.Thumb != tt.want[i] {
+					t.Errorf("chapter %d thumb = %q, want %q", i, c.Thumb, tt.want[i])
+				}
+			}
+		})
+	}
+}
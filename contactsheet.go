@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/freetype/truetype"
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// 联系表配置
+type ContactSheetConfig struct {
+	// 列数和行数
+	Cols, Rows int
+	// 图片宽度
+	Width int
+	// 图片输出配置
+	Output ImageOutput
+	// 字体文件, 为空使用内置的 Go 字体, 文件名有中文时需要指定支持中文的字体
+	FontFile string
+}
+
+var (
+	contactSheetBackground = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+	contactSheetTimeBox    = color.RGBA{A: 0xa0}
+)
+
+const contactSheetMargin = 10
+
+// 生成联系表, 包含文件信息头和带时间戳的缩略图
+func GenContactSheet(ctx context.Context, ffmpeg string, v *Video, out string, cfg ContactSheetConfig) error {
+	if cfg.Cols <= 0 {
+		cfg.Cols = 4
+	}
+	if cfg.Rows <= 0 {
+		cfg.Rows = 5
+	}
+	if cfg.Width <= 0 {
+		cfg.Width = 1600
+	}
+	if v.Duration <= 0 {
+		return errors.Errorf("视频时长未知: %v", v.Path)
+	}
+
+	// 格子的尺寸, 高度按视频比例
+	n := cfg.Cols * cfg.Rows
+	cellW := (cfg.Width - contactSheetMargin*(cfg.Cols+1)) / cfg.Cols
+	cellH := cellW * 9 / 16
+	if v.Width > 0 && v.Height > 0 {
+		cellH = cellW * v.Height / v.Width
+	}
+
+	// 每一段的中间取一帧, 避开片头的黑屏
+	interval := v.Duration / time.Duration(n)
+	offset := interval / 2
+	fps := fmt.Sprintf("%d/%d", n*1000, v.Duration.Milliseconds())
+	frames, times, err := videoFramesFilter(ctx, ffmpeg, v.Path, []string{"-ss", fmt.Sprintf("%.3f", offset.Seconds())}, withToneMap("fps="+fps, ToneMapFilter(ffmpeg, v)), cellW, cellH, "")
+	if err != nil {
+		return err
+	}
+	if len(frames) > n {
+		frames = frames[:n]
+	}
+
+	face, err := loadFontFace(cfg.FontFile, 16)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	videoCodec, audioCodec := v.VideoCodec, v.AudioCodec
+	if videoCodec == "" {
+		videoCodec = "-"
+	}
+	if audioCodec == "" {
+		audioCodec = "-"
+	}
+	lines := []string{
+		"File: " + filepath.Base(v.Path),
+		"Size: " + FormatSize(v.Size),
+		"Duration: " + FormatDuration(v.Duration),
+		fmt.Sprintf("Resolution: %dx%d", v.Width, v.Height),
+		"Codecs: " + videoCodec + " / " + audioCodec,
+	}
+	lineH := face.Metrics().Height.Ceil()
+	headerH := contactSheetMargin*2 + len(lines)*lineH
+	height := headerH + cfg.Rows*(cellH+contactSheetMargin)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+
+	// 文件信息头
+	d := &font.Drawer{Dst: canvas, Src: image.White, Face: face}
+	for i, line := range lines {
+		d.Dot = fixed.P(contactSheetMargin, contactSheetMargin+i*lineH+face.Metrics().Ascent.Ceil())
+		d.DrawString(line)
+	}
+
+	// 缩略图和时间戳
+	for i, frame := range frames {
+		col := i % cfg.Cols
+		row := i / cfg.Cols
+		x := contactSheetMargin + col*(cellW+contactSheetMargin)
+		y := headerH + row*(cellH+contactSheetMargin)
+		rect := image.Rect(x, y, x+cellW, y+cellH)
+		drawThumbImage(canvas, rect, frame, cfg.Output.Filter)
+
+		t := offset + time.Duration(i)*interval
+		if times != nil {
+			t = offset + times[i]
+		}
+		drawTimestamp(canvas, rect, face, FormatDuration(t))
+	}
+
+	err = MkParentDir(out)
+	if err != nil {
+		return errors.WithMessage(err, "联系表目录创建失败")
+	}
+	err = cfg.Output.Write(canvas, out)
+	if err != nil {
+		return errors.WithMessage(err, "联系表写入失败")
+	}
+	return nil
+}
+
+// 在格子的右下角画时间戳, 带半透明背景
+func drawTimestamp(dst draw.Image, r image.Rectangle, face font.Face, text string) {
+	const padding = 4
+	d := &font.Drawer{Dst: dst, Src: image.White, Face: face}
+	w := d.MeasureString(text).Ceil()
+	h := face.Metrics().Height.Ceil()
+
+	box := image.Rect(r.Max.X-w-padding*2, r.Max.Y-h-padding*2, r.Max.X, r.Max.Y)
+	draw.Draw(dst, box, image.NewUniform(contactSheetTimeBox), image.Point{}, draw.Over)
+
+	d.Dot = fixed.P(box.Min.X+padding, box.Min.Y+padding+face.Metrics().Ascent.Ceil())
+	d.DrawString(text)
+}
+
+// 加载字体, 没有指定字体文件使用内置的 Go 字体
+func loadFontFace(file string, size float64) (font.Face, error) {
+	data := goregular.TTF
+	if file != "" {
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.WithMessage(err, "读取字体失败")
+		}
+	}
+	f, err := truetype.Parse(data)
+	if err != nil {
+		return nil, errors.WithMessage(err, "解析字体失败")
+	}
+	return truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72, Hinting: font.HintingFull}), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestFormatSizeAndDuration(t *testing.T) {
+	sizes := map[int64]string{512: "512 B", 1536: "1.5 KB", 3 << 30: "3.0 GB"}
+	for size, want := range sizes {
+		if got := FormatSize(size); got != want {
+			t.Errorf("FormatSize(%d) = %v, want %v", size, got, want)
+		}
+	}
+	if got := FormatDuration(time.Hour + 2*time.Minute + 3600*time.Millisecond); got != "01:02:04" {
+		t.Errorf("FormatDuration() = %v", got)
+	}
+}
+
+func TestDrawTimestamp(t *testing.T) {
+	face, err := loadFontFace("", 16)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer face.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	drawTimestamp(img, img.Bounds(), face, "01:02:03")
+
+	// 左上角不受影响, 右下角有时间戳
+	if c := img.RGBAAt(0, 0); c != (color.RGBA{}) {
+		t.Errorf("左上角 = %v", c)
+	}
+	white := false
+	for x := 100; x < 200; x++ {
+		for y := 70; y < 100; y++ {
+			if c := img.RGBAAt(x, y); c.R > 0xc0 {
+				white = true
+			}
+		}
+	}
+	if !white {
+		t.Errorf("没有画出时间戳")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"image"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 封面的来源
+const (
+	// 视频旁边的图片, 如 poster.jpg
+	CoverSidecar = "sidecar"
+	// 视频内嵌的封面
+	CoverEmbedded = "embedded"
+	// 视频中间的一帧
+	CoverFrame = "frame"
+)
+
+// 封面原图的最大尺寸, 其他尺寸的封面按需从原图缩放
+const (
+	coverMaxWidth  = 1280
+	coverMaxHeight = 720
+)
+
+// 封面原图的尺寸, 不超过视频本身的尺寸
+func CoverSize(v *Video) (int, int) {
+	w, h := coverMaxWidth, coverMaxHeight
+	if v.Width > 0 && v.Height > 0 && v.Width < w && v.Height < h {
+		w, h = v.Width, v.Height
+	}
+	return AdjustAspectRatio(v.Width, v.Height, w, h)
+}
+
+// 作为封面的帧的时间, 取缩略图中间那一帧的时间
+func coverTime(v *Video) time.Duration {
+	if v.Preview != nil && v.Preview.Thumbs != nil {
+		if times := v.Preview.Thumbs.Times; len(times) > 0 {
+			return times[len(times)/2]
+		}
+	}
+	return v.Duration / 2
+}
+
+// 默认的封面来源顺序
+var DefaultCoverOrder = []string{CoverSidecar, CoverEmbedded, CoverFrame}
+
+// 解析封面来源顺序
+func ParseCoverOrder(order []string) ([]string, error) {
+	for _, source := range order {
+		switch source {
+		case CoverSidecar, CoverEmbedded, CoverFrame:
+		default:
+			return nil, errors.Errorf("不支持的封面来源: %v", source)
+		}
+	}
+	return order, nil
+}
+
+// 封面图片的扩展名
+var coverExts = []string{".jpg", ".jpeg", ".png"}
+
+// 查找视频旁边的封面图片, 不存在返回空字符串
+// 优先和视频同名的, 如 movie-poster.jpg, movie.jpg, 然后是目录的 poster, folder, cover, fanart
+func FindSidecarCover(videoPath string) string {
+	dir := filepath.Dir(videoPath)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	names := make(map[string]string, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			names[strings.ToLower(f.Name())] = f.Name()
+		}
+	}
+
+	stem := strings.ToLower(FileName(videoPath))
+	for _, base := range []string{stem + "-poster", stem, "poster", "folder", "cover", "fanart"} {
+		for _, ext := range coverExts {
+			if name, ok := names[base+ext]; ok {
+				return filepath.Join(dir, name)
+			}
+		}
+	}
+	return ""
+}
+
+// 提取视频内嵌的封面
+func ExtractEmbeddedCover(ctx context.Context, ffprobe, ffmpeg, path string) (image.Image, error) {
+	cmd := exec.Command(ffprobe, "-v", "error", "-select_streams", "v", "-show_entries", "stream=index:stream_disposition=attached_pic", "-print_format", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, execError(cmd, err)
+	}
+	pj := struct {
+		Streams []struct {
+			Index       int `json:"index"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}{}
+	err = json.Unmarshal(out, &pj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	index := -1
+	for _, s := range pj.Streams {
+		if s.Disposition.AttachedPic == 1 {
+			index = s.Index
+			break
+		}
+	}
+	if index < 0 {
+		return nil, nil
+	}
+
+	cmd = exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-v", "error", "-i", path, "-map", fmt.Sprintf("0:%d", index), "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, execError(cmd, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		return nil, errors.WithMessage(err, "解码内嵌封面失败")
+	}
+	return img, nil
+}
+
+// 按来源顺序确定封面, 替换生成预览时的封面, 返回封面的来源
+func ResolveCover(ctx context.Context, ffprobe, ffmpeg string, v *Video, order []string, width, height int, output ImageOutput) (string, error) {
+	for _, source := range order {
+		var img image.Image
+		var err error
+		switch source {
+		case CoverSidecar:
+			if p := FindSidecarCover(v.Path); p != "" {
+				img, err = decodeImage(p)
+			}
+		case CoverEmbedded:
+			img, err = ExtractEmbeddedCover(ctx, ffprobe, ffmpeg, v.Path)
+		case CoverFrame:
+			// 生成预览时已经是中间帧, 但尺寸是缩略图的尺寸, 重新获取一张大的
+			img, err = VideoFrame(ctx, ffmpeg, v.Path, coverTime(v), width, height, ToneMapFilter(ffmpeg, v))
+			if err != nil {
+				fmt.Printf("获取封面帧失败, 使用缩略图: %+v\n", err)
+				return CoverFrame, nil
+			}
+		}
+		if err != nil {
+			fmt.Printf("获取封面失败, 来源: %v, %+v\n", source, err)
+			continue
+		}
+		if img == nil {
+			continue
+		}
+
+		// 按图片自己的比例缩放, 不超过封面尺寸
+		if w, h := AdjustAspectRatio(img.Bounds().Dx(), img.Bounds().Dy(), width, height); w != img.Bounds().Dx() || h != img.Bounds().Dy() {
+			img = resize.Resize(uint(w), uint(h), img, output.Filter)
+		}
+		err = output.Write(img, v.Preview.Cover)
+		if err != nil {
+			return "", errors.WithMessage(err, "写入封面失败")
+		}
+		return source, nil
+	}
+	return CoverFrame, nil
+}
+
+// 更新封面的占位信息
+func UpdateCoverPlaceholder(p *VideoPreview) error {
+	img, err := decodeImage(p.Cover)
+	if err != nil {
+		return errors.WithMessage(err, "读取封面失败")
+	}
+	p.BlurHash, p.Color = CoverPlaceholder(img)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSidecarCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cover")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	video := filepath.Join(dir, "Movie.mkv")
+	touch := func(name string) {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, os.ModePerm)
+	}
+
+	if got := FindSidecarCover(video); got != "" {
+		t.Errorf("没有封面图片, got %v", got)
+	}
+	touch("fanart.jpg")
+	touch("Folder.JPG")
+	if got := filepath.Base(FindSidecarCover(video)); got != "Folder.JPG" {
+		t.Errorf("folder 优先于 fanart, got %v", got)
+	}
+	touch("poster.png")
+	if got := filepath.Base(FindSidecarCover(video)); got != "poster.png" {
+		t.Errorf("poster 优先于 folder, got %v", got)
+	}
+	touch("Movie-poster.jpeg")
+	if got := filepath.Base(FindSidecarCover(video)); got != "Movie-poster.jpeg" {
+		t.Errorf("同名的优先, got %v", got)
+	}
+}
+
+func TestResolveCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cover")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ParseCoverOrder([]string{CoverSidecar, "random"}); err == nil {
+		t.Errorf("ParseCoverOrder() 应该返回错误")
+	}
+
+	v := &Video{Path: filepath.Join(dir, "movie.mp4"), Preview: &VideoPreview{Cover: filepath.Join(dir, "preview", "cover.png")}}
+	os.MkdirAll(filepath.Dir(v.Preview.Cover), os.ModePerm)
+
+	// 没有封面图片, 使用帧
+	source, err := ResolveCover(context.Background(), "ffprobe", "ffmpeg", v, []string{CoverSidecar, CoverFrame}, 412, 232, ImageOutput{Format: FormatPng})
+	if err != nil || source != CoverFrame {
+		t.Errorf("ResolveCover() = %v, %v, want %v", source, err, CoverFrame)
+	}
+
+	// 竖的海报按自己的比例缩放
+	f, _ := os.Create(filepath.Join(dir, "poster.png"))
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 200, 300)))
+	f.Close()
+	source, err = ResolveCover(context.Background(), "ffprobe", "ffmpeg", v, []string{CoverSidecar, CoverFrame}, 412, 232, ImageOutput{Format: FormatPng})
+	if err != nil || source != CoverSidecar {
+		t.Fatalf("ResolveCover() = %v, %+v, want %v", source, err, CoverSidecar)
+	}
+	img, err := decodeImage(v.Preview.Cover)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if img.Bounds().Dx() != 154 || img.Bounds().Dy() != 232 {
+		t.Errorf("封面尺寸 = %v", img.Bounds())
+	}
+}
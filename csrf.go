@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 请求头中的 CSRF token, 登录和获取当前用户时在响应头中返回
+const csrfHeader = "X-CSRF-Token"
+
+// 会话的 CSRF token, 由会话签名得到, 不需要保存
+func csrfToken(session string) string {
+	return base64.RawURLEncoding.EncodeToString(signature("csrf:" + session))
+}
+
+// 返回当前会话的 CSRF token, 使用 bearer token 时没有
+func setCSRFHeader(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil && len(signKey) > 0 {
+		w.Header().Set(csrfHeader, csrfToken(c.Value))
+	}
+}
+
+// 标准化 origin, 如 https://Example.com/ -> https://example.com
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// 请求的来源是否和服务是同一个地址
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// 来源是否在允许列表中, 列表中的 * 允许所有来源, 但是不带 cookie
+// 返回是否允许和是否允许带 cookie
+func originAllowed(r *http.Request, origin string, allowed []string) (bool, bool) {
+	if sameOrigin(r, origin) {
+		return true, true
+	}
+	origin = normalizeOrigin(origin)
+	wildcard := false
+	for _, a := range allowed {
+		if a == "*" {
+			wildcard = true
+		} else if normalizeOrigin(a) == origin {
+			return true, true
+		}
+	}
+	return wildcard, false
+}
+
+// 会修改数据的请求
+func isStateChanging(method string) bool {
+	return method != GET && method != "HEAD" && method != "OPTIONS"
+}
+
+// 请求的来源, 优先使用 Origin, 没有时使用 Referer
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+	if ref := r.Header.Get("Referer"); ref != "" {
+		if u, err := url.Parse(ref); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return ""
+}
+
+// 检查会修改数据的请求是不是伪造的
+// bearer token 不会被浏览器自动带上, 不需要检查
+// 带有正确的 CSRF token, 或者来源是同一个地址或允许带 cookie 的来源时通过, 登录请求也会检查来源
+func checkCSRF(r *http.Request, allowed []string) bool {
+	if !isStateChanging(r.Method) || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	if token := r.Header.Get(csrfHeader); token != "" {
+		c, err := r.Cookie(sessionCookie)
+		return err == nil && len(signKey) > 0 && hmac.Equal([]byte(token), []byte(csrfToken(c.Value)))
+	}
+	origin := requestOrigin(r)
+	if origin == "" {
+		// 浏览器跨域提交时一定会带上 Origin, 没有来源又带着会话 cookie 的请求无法确认
+		_, err := r.Cookie(sessionCookie)
+		return err != nil
+	}
+	_, credentials := originAllowed(r, origin, allowed)
+	return credentials
+}
+
+// CSRF 中间件, 所有会修改数据的请求都需要检查
+func csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkCSRF(r, conf.AllowOrigins) {
+			WriteError(w, r, NewError(ErrForbidden, "请求来源无法验证"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
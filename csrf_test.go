@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	old := signKey
+	defer func() { signKey = old }()
+	signKey = []byte(strings.Repeat("k", 32))
+
+	allowed := []string{"https://app.example.com/", "*"}
+	cookie := func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "session"})
+	}
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		cookie bool
+		want   bool
+	}{
+		{"GET 不检查", GET, map[string]string{"Origin": "https://evil.com"}, true, true},
+		{"同一个地址", POST, map[string]string{"Origin": "http://night.local:8080"}, true, true},
+		{"允许的来源", PUT, map[string]string{"Origin": "https://APP.example.com"}, true, true},
+		{"* 不能带 cookie", DELETE, map[string]string{"Origin": "https://evil.com"}, true, false},
+		{"其他来源", POST, map[string]string{"Origin": "https://evil.com"}, false, false},
+		{"Referer", POST, map[string]string{"Referer": "http://night.local:8080/web/index.html"}, true, true},
+		{"其他 Referer", POST, map[string]string{"Referer": "https://evil.com/a"}, true, false},
+		{"没有来源带 cookie", POST, nil, true, false},
+		{"没有来源不带 cookie", POST, nil, false, true},
+		{"bearer token", POST, map[string]string{"Origin": "https://evil.com", "Authorization": "Bearer night_x"}, false, true},
+		{"CSRF token", POST, map[string]string{"Origin": "https://evil.com", csrfHeader: csrfToken("session")}, true, true},
+		{"错误的 CSRF token", POST, map[string]string{csrfHeader: csrfToken("other")}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://night.local:8080/videos/1/watched", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.cookie {
+				cookie(r)
+			}
+			if got := checkCSRF(r, allowed); got != tt.want {
+				t.Errorf("checkCSRF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCors(t *testing.T) {
+	old := conf
+	defer func() { conf = old }()
+	conf.AllowOrigins = []string{"https://app.example.com"}
+
+	h := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		want        int
+		allow       string
+		credentials string
+	}{
+		{"允许的来源", GET, "https://app.example.com", http.StatusNoContent, "https://app.example.com", "true"},
+		{"不允许的来源", GET, "https://evil.com", http.StatusNoContent, "", ""},
+		{"允许的预检", "OPTIONS", "https://app.example.com", http.StatusOK, "https://app.example.com", "true"},
+		{"不允许的预检", "OPTIONS", "https://evil.com", http.StatusForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://night.local/resources", nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", PUT)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %v, want %v", got, tt.allow)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("Access-Control-Allow-Credentials = %v, want %v", got, tt.credentials)
+			}
+		})
+	}
+}
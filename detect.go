@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// 已知的视频扩展名
+var videoExts = map[string]bool{
+	".mp4": true, ".m4v": true, ".mov": true, ".qt": true, ".3gp": true, ".3g2": true,
+	".mkv": true, ".webm": true, ".avi": true, ".divx": true, ".flv": true, ".f4v": true,
+	".wmv": true, ".asf": true, ".rm": true, ".rmvb": true, ".m2ts": true, ".mts": true,
+	".mpg": true, ".mpeg": true, ".vob": true, ".ogv": true, ".mxf": true,
+}
+
+// 有歧义的扩展名, 必须通过文件头确认, 比如 .ts 也可能是 TypeScript 源码
+var ambiguousExts = map[string]bool{
+	".ts": true,
+}
+
+// 未下载完成的临时文件扩展名
+var partialExts = map[string]bool{
+	".part": true, ".crdownload": true, ".download": true, ".tmp": true, ".aria2": true,
+	".!qb": true, ".!ut": true, ".bc!": true, ".td": true, ".opdownload": true,
+}
+
+// 纯音频的扩展名, 部分容器格式和视频相同, 需要排除
+var audioExts = map[string]bool{
+	".m4a": true, ".m4b": true, ".m4p": true, ".wma": true, ".ogg": true, ".oga": true,
+	".opus": true, ".mka": true, ".ra": true, ".mp3": true, ".flac": true, ".wav": true,
+}
+
+// isobmff 中表示非视频的品牌
+var nonVideoBrands = map[string]bool{
+	"M4A ": true, "M4B ": true, "M4P ": true, "F4A ": true, "F4B ": true,
+	"heic": true, "heix": true, "mif1": true, "msf1": true, "avif": true,
+}
+
+// 识别文件头需要读取的字节数, 需要覆盖3个 m2ts 包
+const sniffLen = 3 * 192
+
+// 根据文件头识别容器格式, 无法识别返回空字符串
+func SniffContainer(head []byte) string {
+	has := func(off int, sig []byte) bool {
+		return len(head) >= off+len(sig) && bytes.Equal(head[off:off+len(sig)], sig)
+	}
+	switch {
+	case has(0, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "matroska"
+	case has(0, []byte("RIFF")) && has(8, []byte("AVI ")):
+		return "avi"
+	case has(0, []byte("FLV")) && len(head) > 3 && head[3] == 1:
+		return "flv"
+	case has(0, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}):
+		return "asf"
+	case has(0, []byte(".RMF")):
+		return "rm"
+	case has(0, []byte{0x00, 0x00, 0x01, 0xBA}), has(0, []byte{0x00, 0x00, 0x01, 0xB3}):
+		return "mpeg"
+	case has(0, []byte("OggS")):
+		// ogg 大多是音频, 只有包含 theora 流才算视频
+		if bytes.Contains(head, []byte("\x80theora")) {
+			return "ogg"
+		}
+		return ""
+	case has(4, []byte("ftyp")):
+		if len(head) >= 12 && nonVideoBrands[string(head[8:12])] {
+			return ""
+		}
+		return "mp4"
+	case has(4, []byte("moov")), has(4, []byte("mdat")), has(4, []byte("wide")), has(4, []byte("free")), has(4, []byte("pnot")):
+		return "mov"
+	}
+
+	// mpeg-ts 188字节一个包, m2ts 每个包前多了4字节的时间戳
+	if isTransportStream(head, 0, 188) {
+		return "mpegts"
+	}
+	if isTransportStream(head, 4, 192) {
+		return "m2ts"
+	}
+	return ""
+}
+
+// 每个包的开头都是同步字节 0x47
+func isTransportStream(head []byte, offset, packet int) bool {
+	n := 0
+	for i := offset; i < len(head); i += packet {
+		if head[i] != 0x47 {
+			return false
+		}
+		n++
+	}
+	// 至少要有两个包才能确认
+	return n >= 2
+}
+
+// 视频检测器
+type VideoDetector struct {
+	// 用于确认的 ffprobe, 为空不确认
+	FFprobe string
+}
+
+var defaultDetector = &VideoDetector{}
+
+// 是否视频文件
+func (d *VideoDetector) IsVideo(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if partialExts[ext] || audioExts[ext] {
+		return false
+	}
+
+	head, err := readHead(path, sniffLen)
+	if err != nil {
+		return false
+	}
+
+	var candidate bool
+	if container := SniffContainer(head); container != "" {
+		candidate = true
+	} else if videoExts[ext] {
+		// 扩展名是视频, 但文件头不认识, 比如一些比较少见的格式
+		candidate = true
+	} else if !ambiguousExts[ext] {
+		candidate = strings.Contains(http.DetectContentType(head), "video")
+	}
+
+	if !candidate {
+		return false
+	}
+	if d.FFprobe == "" {
+		return true
+	}
+	return ProbeHasVideo(d.FFprobe, path)
+}
+
+// 读取文件的开头
+func readHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buffer := make([]byte, n)
+	read, err := f.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:read], nil
+}
+
+// 使用 ffprobe 确认文件包含视频流, 封面图片不算
+func ProbeHasVideo(ffprobe, path string) bool {
+	cmd := exec.Command(ffprobe, "-v", "error", "-select_streams", "v", "-show_entries", "stream=codec_type:stream_disposition=attached_pic", "-print_format", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+
+	pj := struct {
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}{}
+	if err := json.Unmarshal(out, &pj); err != nil {
+		return false
+	}
+	for _, s := range pj.Streams {
+		if s.CodecType == "video" && s.Disposition.AttachedPic == 0 {
+			return true
+		}
+	}
+	return false
+}
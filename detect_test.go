@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tsPackets(offset, packet, n int) []byte {
+	b := make([]byte, packet*n)
+	for i := 0; i < n; i++ {
+		b[offset+i*packet] = 0x47
+	}
+	return b
+}
+
+func TestSniffContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{name: "mkv", head: []byte{0x1A, 0x45, 0xDF, 0xA3, 0x01}, want: "matroska"},
+		{name: "avi", head: []byte("RIFF\x00\x00\x00\x00AVI LIST"), want: "avi"},
+		{name: "flv", head: []byte("FLV\x01\x05"), want: "flv"},
+		{name: "wmv", head: []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}, want: "asf"},
+		{name: "rmvb", head: []byte(".RMF\x00\x00\x00\x12"), want: "rm"},
+		{name: "mp4", head: []byte("\x00\x00\x00\x20ftypisom"), want: "mp4"},
+		{name: "m4a", head: []byte("\x00\x00\x00\x20ftypM4A "), want: ""},
+		{name: "mov", head: []byte("\x00\x00\x00\x08wide"), want: "mov"},
+		{name: "mpegts", head: tsPackets(0, 188, 3), want: "mpegts"},
+		{name: "m2ts", head: tsPackets(4, 192, 3), want: "m2ts"},
+		{name: "ogg音频", head: []byte("OggS\x00\x02\x01vorbis"), want: ""},
+		{name: "文本", head: []byte("export const a = 1;"), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffContainer(tt.head); got != tt.want {
+				t.Errorf("SniffContainer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoDetector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detect")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"a.ts":       tsPackets(0, 188, 3),
+		"b.ts":       []byte("export const a = 1;"),
+		"c.mkv.part": {0x1A, 0x45, 0xDF, 0xA3},
+		"d.rmvb":     []byte("unknown"),
+		"e.bin":      []byte("\x00\x00\x00\x20ftypisom"),
+		"f.txt":      []byte("hello"),
+	}
+	want := map[string]bool{"a.ts": true, "b.ts": false, "c.mkv.part": false, "d.rmvb": true, "e.bin": true, "f.txt": false}
+
+	d := &VideoDetector{}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, data, os.ModePerm); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if got := d.IsVideo(p); got != want[name] {
+			t.Errorf("IsVideo(%v) = %v, want %v", name, got, want[name])
+		}
+	}
+}
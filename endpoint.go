@@ -2,22 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"image"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ResultCode struct {
-	Code int         `json:"code"`
-	Msg  string      `json:"msg"`
-	Data interface{} `json:"data"`
+	Code int `json:"code"`
+	// 失败时的错误码
+	Error ErrCode     `json:"error,omitempty"`
+	Msg   string      `json:"msg"`
+	Data  interface{} `json:"data"`
 }
 
 // 写入json到响应
 func WriteJson(w http.ResponseWriter, v interface{}) {
+	WriteJsonStatus(w, http.StatusOK, v)
+}
+
+// 写入json和状态码到响应
+func WriteJsonStatus(w http.ResponseWriter, status int, v interface{}) {
 	bytes, err := json.Marshal(v)
 	if err != nil {
 		log.Printf("返回结果序列化错误, rc: %v, err: %+v", v, err)
@@ -28,6 +44,7 @@ func WriteJson(w http.ResponseWriter, v interface{}) {
 		}
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
 	_, err = w.Write(bytes)
 	if err != nil {
 		log.Printf("无法写入http响应: %+v", err)
@@ -40,43 +57,426 @@ func OkCode(w http.ResponseWriter, v interface{}) {
 	WriteJson(w, rc)
 }
 
-// 写入失败结果
-func ErrorCode(w http.ResponseWriter, msg string) {
-	rc := &ResultCode{Code: -1, Msg: msg}
-	WriteJson(w, rc)
+// 写入预览生成中的结果, 状态码 202
+func PendingCode(w http.ResponseWriter, r *http.Request, v interface{}) {
+	rc := &ResultCode{Code: 1, Msg: translate(requestLang(r), "预览生成中"), Data: v}
+	WriteJsonStatus(w, http.StatusAccepted, rc)
+}
+
+// 预览还没有生成时, 把视频提前到生成队列的最前面并写入等待结果, 返回是否已经写入结果
+func previewPending(w http.ResponseWriter, r *http.Request, v *Video) bool {
+	if v.Preview != nil {
+		return false
+	}
+	if previewQueue.Prioritize(v.Path) {
+		PendingCode(w, r, v)
+	} else {
+		WriteError(w, r, NewError(ErrNotFound, "预览还没有生成"))
+	}
+	return true
 }
 
-// 获取所有的资源
+// 获取视频详情, 预览还没有生成的提前生成
+func GetVideo(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	uv := history.UserVideos(CurrentUser(r).Name, []*Video{v})[0]
+	if v.Preview == nil && previewQueue.Prioritize(v.Path) {
+		PendingCode(w, r, uv)
+		return
+	}
+	OkCode(w, uv)
+}
+
+// 获取所有的资源, 可以按标签 tag, 合集 collection 和收藏 favorite 过滤, 或者使用智能播放列表的查询 q 搜索
 func GetAllResources(w http.ResponseWriter, r *http.Request) {
-	res := Videos()
+	q := r.URL.Query()
+	var collection *Collection
+	if cid := q.Get("collection"); cid != "" {
+		c, ok := organize.Collection(cid)
+		if !ok {
+			WriteError(w, r, NewError(ErrNotFound, "合集不存在"))
+			return
+		}
+		collection = &c
+	}
+	res, ok := searchVideos(w, r, FilterVideos(currentUserVideos(r), q.Get("tag"), collection, q.Get("favorite") == "true"))
+	if !ok {
+		return
+	}
+	OkCode(w, res)
+}
+
+// 获取所有库的状态
+func GetLibraries(w http.ResponseWriter, r *http.Request) {
+	var res []*LibraryStatus
+	for _, lib := range Libraries() {
+		if canAccess(r, lib.Dir) {
+			res = append(res, lib)
+		}
+	}
 	OkCode(w, res)
 }
 
 // 获取资源内容
 func GetContent(w http.ResponseWriter, r *http.Request) {
 	p := r.URL.Query().Get("path")
+	// 只能获取视频和视频的预览
+	if v := contentVideo(p); v == nil || !canAccess(r, v.Path) {
+		WriteError(w, r, NewError(ErrNotFound, "资源不存在"))
+		return
+	}
 	http.ServeFile(w, r, p)
 }
 
+// 获取视频的章节
+func GetVideoChapters(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	OkCode(w, v.Chapters)
+}
+
+// 获取视频的字幕列表
+func GetVideoSubtitles(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	// 字幕和预览一起生成
+	if previewPending(w, r, v) {
+		return
+	}
+	OkCode(w, v.Subtitles)
+}
+
+// 获取视频的字幕内容, webvtt 格式
+func GetVideoSubtitle(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	sub := v.Subtitle(mux.Vars(r)["sid"])
+	if sub == nil {
+		WriteError(w, r, NewError(ErrNotFound, "字幕不存在"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeFile(w, r, sub.Path)
+}
+
+// 获取视频的联系表, 第一次请求时生成并缓存
+func GetVideoContactSheet(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+
+	out := filepath.Join(conf.CacheDir, "contactsheets", v.ID+conf.ContactSheet.Output.Ext())
+	if !IsFileExists(out) {
+		if err := genContactSheetFile(r.Context(), v, out); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+	}
+	http.ServeFile(w, r, out)
+}
+
+// 生成视频的联系表, 同一个视频同时只生成一次, 先写临时文件, 不会读到写了一半的联系表
+func genContactSheetFile(ctx context.Context, v *Video, out string) error {
+	unlock := contactSheetLocks.Lock(out)
+	defer unlock()
+	// 等待的时候其他请求可能已经生成了
+	if IsFileExists(out) {
+		return nil
+	}
+	// 重新获取视频信息, 旧的缓存里没有编码信息
+	info, err := VideoInfo(conf.FFprobe, v.Path)
+	if err != nil {
+		return err
+	}
+	tmp := tempPath(out)
+	if err = GenContactSheet(ctx, conf.FFmpeg, info, tmp, conf.ContactSheet); err == nil {
+		err = errors.WithStack(os.Rename(tmp, out))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return WrapError(err, ErrMediaFailed, "联系表生成失败")
+}
+
+// 帧的最大宽度
+const maxFrameWidth = 3840
+
+// 请求的宽度对应的帧尺寸, 保持视频比例
+func frameSize(v *Video, w int) (int, int) {
+	if v.Width <= 0 || v.Height <= 0 {
+		return AdjustAspectRatio(16, 9, w, w*9/16)
+	}
+	return AdjustAspectRatio(v.Width, v.Height, w, w*v.Height/v.Width)
+}
+
+// 获取视频任意时间点的一帧, t 为时间点, w 为宽度
+func GetVideoFrame(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	q := r.URL.Query()
+	t, err := ParseTimestamp(q.Get("t"))
+	if err != nil || t > v.Duration {
+		WriteError(w, r, NewError(ErrBadRequest, "时间点错误"))
+		return
+	}
+	width := 320
+	if ws := q.Get("w"); ws != "" {
+		width, err = strconv.Atoi(ws)
+		if err != nil || width <= 0 || width > maxFrameWidth {
+			WriteError(w, r, NewError(ErrBadRequest, "宽度错误"))
+			return
+		}
+	}
+
+	key := fmt.Sprintf("%s_%d_%d%s", v.ID, t.Milliseconds(), width, conf.ImageOutput.Ext())
+	if p, ok := frameCache.Get(key); ok {
+		http.ServeFile(w, r, p)
+		return
+	}
+
+	fw, fh := frameSize(v, width)
+	frame, err := VideoFrame(r.Context(), conf.FFmpeg, v.Path, t, fw, fh, ToneMapFilter(conf.FFmpeg, v))
+	if err == nil {
+		err = conf.ImageOutput.Write(frame, frameCache.Path(key))
+	}
+	if err == nil {
+		err = frameCache.Put(key)
+	}
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrMediaFailed, "获取帧失败"))
+		return
+	}
+	http.ServeFile(w, r, frameCache.Path(key))
+}
+
+// 封面可选的宽度, 请求的宽度向上取整到这些宽度, 避免缓存太多尺寸
+var coverWidths = []int{160, 320, 480, 640, 960, 1280}
+
+// 取整后的封面宽度, 不小于请求的宽度, 超过原图宽度时返回0表示使用原图
+func coverWidth(width, original int) int {
+	for _, cw := range coverWidths {
+		if cw >= width {
+			width = cw
+			break
+		}
+	}
+	if width >= original {
+		return 0
+	}
+	return width
+}
+
+// 获取指定宽度的封面, w 为宽度, 不传返回原图, 用于 srcset
+func GetVideoImage(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	if previewPending(w, r, v) {
+		return
+	}
+	info, err := os.Stat(v.Preview.Cover)
+	if err != nil {
+		WriteError(w, r, NewError(ErrNotFound, "封面不存在"))
+		return
+	}
+
+	width := 0
+	if ws := r.URL.Query().Get("w"); ws != "" {
+		width, err = strconv.Atoi(ws)
+		if err != nil || width <= 0 {
+			WriteError(w, r, NewError(ErrBadRequest, "宽度错误"))
+			return
+		}
+	}
+	if width == 0 {
+		http.ServeFile(w, r, v.Preview.Cover)
+		return
+	}
+
+	// 原图的宽度需要解码才知道, 先查缓存
+	// 封面可能被替换, 缓存的 key 带上封面的修改时间
+	keyOf := func(width int) string {
+		return fmt.Sprintf("cover_%s_%d_%d%s", v.ID, info.ModTime().UnixNano(), width, filepath.Ext(v.Preview.Cover))
+	}
+	for _, cw := range coverWidths {
+		if cw >= width {
+			if p, ok := frameCache.Get(keyOf(cw)); ok {
+				http.ServeFile(w, r, p)
+				return
+			}
+			break
+		}
+	}
+
+	img, err := decodeImage(v.Preview.Cover)
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "读取封面失败"))
+		return
+	}
+	width = coverWidth(width, img.Bounds().Dx())
+	if width == 0 {
+		http.ServeFile(w, r, v.Preview.Cover)
+		return
+	}
+
+	key := keyOf(width)
+	height := img.Bounds().Dy() * width / img.Bounds().Dx()
+	output := conf.ImageOutput
+	output.Format = imageFormatOf(v.Preview.Cover)
+	err = output.Write(resize.Resize(uint(width), uint(height), img, output.Filter), frameCache.Path(key))
+	if err == nil {
+		err = frameCache.Put(key)
+	}
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "缩放封面失败"))
+		return
+	}
+	http.ServeFile(w, r, frameCache.Path(key))
+}
+
+// 使用任意时间点的一帧作为封面, t 为时间点
+func SetVideoCover(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	if previewPending(w, r, v) {
+		return
+	}
+	t, err := ParseTimestamp(r.URL.Query().Get("t"))
+	if err != nil || t > v.Duration {
+		WriteError(w, r, NewError(ErrBadRequest, "时间点错误"))
+		return
+	}
+
+	// 和生成预览时的封面尺寸一样
+	cw, ch := CoverSize(v)
+	frame, err := VideoFrame(r.Context(), conf.FFmpeg, v.Path, t, cw, ch, ToneMapFilter(conf.FFmpeg, v))
+	var preview *VideoPreview
+	if err == nil {
+		preview, err = replaceCover(v, frame)
+	}
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrMediaFailed, "设置封面失败"))
+		return
+	}
+	OkCode(w, preview)
+}
+
+// 替换视频的封面, 先写临时文件再改名, 正在读取封面的请求不会读到写了一半的文件
+// 原来的视频信息可能正在被读取, 修改副本后替换, 并保存到缓存文件
+func replaceCover(v *Video, frame image.Image) (*VideoPreview, error) {
+	unlock := coverLocks.Lock(v.Preview.Cover)
+	defer unlock()
+
+	// 封面的格式保持不变
+	output := conf.ImageOutput
+	output.Format = imageFormatOf(v.Preview.Cover)
+	tmp := tempPath(v.Preview.Cover)
+	if err := output.Write(frame, tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, v.Preview.Cover); err != nil {
+		os.Remove(tmp)
+		return nil, errors.WithStack(err)
+	}
+
+	// 等待锁的时候视频信息可能已经更新
+	if latest := VideoByID(v.ID); latest != nil && latest.Preview != nil {
+		v = latest
+	}
+	nv := v.Clone()
+	nv.Preview.CoverSource = CoverFrame
+	nv.Preview.BlurHash, nv.Preview.Color = CoverPlaceholder(frame)
+	addCacheVideo(nv)
+	writeCache(cacheFile(conf.CacheDir))
+	return nv.Preview, nil
+}
+
+// 服务配置
+type ServerConfig struct {
+	Port     int
+	CacheDir string
+	FFprobe  string
+	FFmpeg   string
+	// 联系表配置
+	ContactSheet ContactSheetConfig
+	// 帧和封面的输出配置
+	ImageOutput ImageOutput
+	// 帧和缩放封面缓存的大小限制
+	FrameCacheSize int64
+	// 视频库, 用于访问控制
+	Libraries []*Library
+	// 使用 https, 没有指定证书时使用缓存目录中的自签名证书
+	TLS     bool
+	TLSCert string
+	TLSKey  string
+	// http 跳转到 https 的端口, 0 不跳转
+	RedirectPort int
+	// 允许跨域访问的来源, 如 https://example.com, * 允许所有来源但是不带 cookie
+	AllowOrigins []string
+}
+
 var (
-	srv http.Server
+	srv  http.Server
+	conf ServerConfig
+	// http 跳转 https 的服务
+	redirectSrv http.Server
+	// https 使用的证书, SIGHUP 时重新读取
+	certs *CertReloader
+	// SIGHUP 和定期检查可能同时重新生成证书, 同时只生成和读取一次
+	certsMu sync.Mutex
+	// 每个联系表文件一个锁, 同一个视频的联系表同时只生成一次
+	contactSheetLocks keyLocks
+	// 每个封面文件一个锁, 同时设置同一个封面时不会互相覆盖临时文件
+	coverLocks keyLocks
+	frameCache *FrameCache
 )
 
 // http 方法
 const (
-	GET = "GET"
+	GET    = "GET"
+	PUT    = "PUT"
+	POST   = "POST"
+	DELETE = "DELETE"
 )
 
-// 跨域中间件
+// 跨域中间件, 只允许同一个地址和 AllowOrigins 中的来源
 func cors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		header := w.Header()
 
 		if origin := r.Header.Get("Origin"); origin != "" {
-			header.Set("Access-Control-Allow-Origin", origin)
+			header.Add("Vary", "Origin")
+			allowed, credentials := originAllowed(r, origin, conf.AllowOrigins)
+			if allowed {
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Set("Access-Control-Expose-Headers", csrfHeader)
+				if credentials {
+					header.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
 
 			if r.Method == "OPTIONS" {
 				// Preflight request
+				if !allowed {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
 				if allowMethod := r.Header.Get("Access-Control-Request-Method"); allowMethod != "" {
 					header.Set("Access-Control-Allow-Methods", allowMethod)
 				}
@@ -93,21 +493,180 @@ func cors(next http.Handler) http.Handler {
 	})
 }
 
-func Start(port int) {
+// 启动服务, 数据读取或证书准备失败时直接退出, 避免只有扫描在运行
+func Start(c ServerConfig) {
+	conf = c
+	var err error
+	frameCache, err = NewFrameCache(filepath.Join(conf.CacheDir, "frames"), conf.FrameCacheSize)
+	if err != nil {
+		log.Fatalf("帧缓存创建失败: %+v", err)
+	}
+	if err = LoadUsers(filepath.Join(conf.CacheDir, "users.json")); err != nil {
+		log.Fatalf("用户信息读取失败: %+v", err)
+	}
+	if err = LoadHistory(filepath.Join(conf.CacheDir, "history.json")); err != nil {
+		log.Fatalf("观看记录读取失败: %+v", err)
+	}
+	go flushHistory()
+	if err = LoadOrganize(filepath.Join(conf.CacheDir, "organize.json")); err != nil {
+		log.Fatalf("收藏信息读取失败: %+v", err)
+	}
+	if err = LoadSmartLists(filepath.Join(conf.CacheDir, "playlists.json")); err != nil {
+		log.Fatalf("播放列表读取失败: %+v", err)
+	}
+	if err = LoadSignKey(filepath.Join(conf.CacheDir, "sign.key")); err != nil {
+		log.Fatalf("签名密钥读取失败: %+v", err)
+	}
+	if err = LoadShares(filepath.Join(conf.CacheDir, "shares.json")); err != nil {
+		log.Fatalf("分享链接读取失败: %+v", err)
+	}
+	if err = users.EnsureAdmin(); err != nil {
+		log.Fatalf("创建管理员失败: %+v", err)
+	}
+
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	r.HandleFunc("/login", Login).Methods(POST)
+	r.HandleFunc("/logout", Logout).Methods(POST)
+	r.HandleFunc("/me", GetCurrentUser).Methods(GET)
+	r.HandleFunc("/tokens", GetTokens).Methods(GET)
+	r.HandleFunc("/tokens", AddToken).Methods(POST)
+	r.HandleFunc("/tokens/{tid}", RemoveToken).Methods(DELETE)
+	r.HandleFunc("/users", adminOnly(GetUsers)).Methods(GET)
+	r.HandleFunc("/users", adminOnly(AddUser)).Methods(POST)
+	r.HandleFunc("/users/{name}", adminOnly(RemoveUser)).Methods(DELETE)
+	r.HandleFunc("/users/{name}/password", SetUserPassword).Methods(PUT)
+	r.HandleFunc("/users/{name}/groups", adminOnly(SetUserGroups)).Methods(PUT)
+	r.HandleFunc("/access", adminOnly(GetAccessRules)).Methods(GET)
+	r.HandleFunc("/access", adminOnly(SetAccessRules)).Methods(PUT)
+	r.HandleFunc("/hidden/pin", adminOnly(SetHiddenPin)).Methods(PUT)
+	r.HandleFunc("/hidden/unlock", UnlockHidden).Methods(POST)
+	r.HandleFunc("/hidden/lock", LockHidden).Methods(POST)
 	r.HandleFunc("/resources", GetAllResources).Methods(GET)
 	r.HandleFunc("/content", GetContent).Methods(GET)
+	r.HandleFunc("/libraries", GetLibraries).Methods(GET)
+	r.HandleFunc("/videos/{id}", GetVideo).Methods(GET)
+	r.HandleFunc("/videos/{id}/progress", ReportProgress).Methods(PUT)
+	r.HandleFunc("/videos/{id}/watched", SetWatched).Methods(PUT)
+	r.HandleFunc("/history/continue", GetContinueWatching).Methods(GET)
+	r.HandleFunc("/history/recent", GetRecentlyWatched).Methods(GET)
+	r.HandleFunc("/history/unwatched", GetUnwatched).Methods(GET)
+	r.HandleFunc("/videos/{id}/favorite", SetFavorite).Methods(PUT)
+	r.HandleFunc("/videos/{id}/tags", SetVideoTags).Methods(PUT)
+	r.HandleFunc("/favorites", GetFavorites).Methods(GET)
+	r.HandleFunc("/tags", GetTags).Methods(GET)
+	r.HandleFunc("/collections", GetCollections).Methods(GET)
+	r.HandleFunc("/collections", AddCollection).Methods(POST)
+	r.HandleFunc("/collections/{cid}", GetCollection).Methods(GET)
+	r.HandleFunc("/collections/{cid}", SetCollection).Methods(PUT)
+	r.HandleFunc("/collections/{cid}", RemoveCollection).Methods(DELETE)
+	r.HandleFunc("/collections/{cid}/videos/{id}", AddCollectionVideo).Methods(PUT)
+	r.HandleFunc("/collections/{cid}/videos/{id}", RemoveCollectionVideo).Methods(DELETE)
+	r.HandleFunc("/playlists", GetSmartPlaylists).Methods(GET)
+	r.HandleFunc("/playlists", SaveSmartPlaylist).Methods(POST)
+	r.HandleFunc("/playlists/{pid:[0-9a-f]+}.{format:m3u8|xspf}", GetSmartPlaylistFile).Methods(GET)
+	r.HandleFunc("/export.{format:m3u8|xspf}", ExportPlaylist).Methods(GET)
+	r.HandleFunc("/playlists/{pid}", GetSmartPlaylist).Methods(GET)
+	r.HandleFunc("/playlists/{pid}", SaveSmartPlaylist).Methods(PUT)
+	r.HandleFunc("/playlists/{pid}", RemoveSmartPlaylist).Methods(DELETE)
+	r.HandleFunc("/videos/{id}/shares", AddShare).Methods(POST)
+	r.HandleFunc("/shares", GetShares).Methods(GET)
+	r.HandleFunc("/shares/{sid}", RemoveShare).Methods(DELETE)
+	r.HandleFunc("/share/{token}", GetShare).Methods(GET)
+	r.HandleFunc("/share/{grant}/stream", GetShareStream).Methods(GET)
+	r.HandleFunc("/share/{grant}/cover", GetShareCover).Methods(GET)
+	r.HandleFunc("/share/{grant}/subtitles/{sid}", GetShareSubtitle).Methods(GET)
+	r.HandleFunc("/videos/{id}/chapters", GetVideoChapters).Methods(GET)
+	r.HandleFunc("/videos/{id}/contactsheet", GetVideoContactSheet).Methods(GET)
+	r.HandleFunc("/videos/{id}/frame", GetVideoFrame).Methods(GET)
+	r.HandleFunc("/videos/{id}/cover", SetVideoCover).Methods(PUT)
+	r.HandleFunc("/images/{id}", GetVideoImage).Methods(GET)
+	r.HandleFunc("/videos/{id}/subtitles", GetVideoSubtitles).Methods(GET)
+	r.HandleFunc("/videos/{id}/subtitles/{sid}", GetVideoSubtitle).Methods(GET)
 	r.Handle("/", http.RedirectHandler("/web", http.StatusMovedPermanently))
 	r.PathPrefix("/web").Handler(http.StripPrefix("/web", http.FileServer(AssetFile())))
 
-	log.Printf("http server listen at :%v", port)
-	srv = http.Server{Addr: fmt.Sprintf(":%d", port), Handler: cors(r)}
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Printf("http server exit with error: %+v", err)
+	srv = http.Server{Addr: fmt.Sprintf(":%d", conf.Port), Handler: cors(csrf(auth(r)))}
+	if !conf.TLS {
+		log.Printf("http server listen at :%v", conf.Port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("http server exit with error: %+v", err)
+		}
+		return
+	}
+
+	certFile, keyFile := conf.TLSCert, conf.TLSKey
+	if certFile == "" {
+		certFile = filepath.Join(conf.CacheDir, "tls", "cert.pem")
+		keyFile = filepath.Join(conf.CacheDir, "tls", "key.pem")
+		if err = EnsureSelfSignedCert(certFile, keyFile); err != nil {
+			log.Fatalf("自签名证书生成失败: %+v", err)
+		}
+		log.Printf("使用自签名证书: %v", certFile)
+	}
+	if certs, err = NewCertReloader(certFile, keyFile); err != nil {
+		log.Fatalf("证书读取失败: %+v", err)
+	}
+	if conf.TLSCert == "" {
+		go renewSelfSignedCert()
+	}
+	srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+
+	if conf.RedirectPort > 0 {
+		redirectSrv = http.Server{Addr: fmt.Sprintf(":%d", conf.RedirectPort), Handler: redirectHTTPS(conf.Port)}
+		go func() {
+			log.Printf("http redirect server listen at :%v", conf.RedirectPort)
+			if err := redirectSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("http redirect server exit with error: %+v", err)
+			}
+		}()
+	}
+
+	log.Printf("https server listen at :%v", conf.Port)
+	if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Printf("https server exit with error: %+v", err)
+	}
+}
+
+// 重新读取证书, 已经建立的连接继续使用原来的证书, 正在播放的视频不会中断
+// 使用自签名证书时先检查是否快过期, 快过期时重新生成
+func ReloadCertificate() {
+	if certs == nil {
+		log.Printf("没有使用 https, 不需要重新读取证书")
+		return
+	}
+	certsMu.Lock()
+	defer certsMu.Unlock()
+	if conf.TLSCert == "" {
+		if err := EnsureSelfSignedCert(certs.certFile, certs.keyFile); err != nil {
+			log.Printf("自签名证书生成失败, 继续使用原来的证书: %+v", err)
+			return
+		}
+	}
+	if err := certs.Reload(); err != nil {
+		log.Printf("证书重新读取失败, 继续使用原来的证书: %+v", err)
+		return
+	}
+	log.Printf("证书已重新读取")
+}
+
+// 定期检查自签名证书, 长时间运行也不会过期
+func renewSelfSignedCert() {
+	ticker := time.NewTicker(selfSignedCheck)
+	defer ticker.Stop()
+	for range ticker.C {
+		ReloadCertificate()
 	}
 }
 
 func Stop(ctx context.Context) {
+	if err := history.Flush(); err != nil {
+		log.Printf("观看记录保存失败: %+v", err)
+	}
+	if err := redirectSrv.Shutdown(ctx); err != nil {
+		log.Printf("http redirect server shutdown error: %+v", err)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("http server shutdown error: %+v", err)
 	}
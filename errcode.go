@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 错误码, 给程序判断用的, 不会改变
+type ErrCode string
+
+const (
+	ErrBadRequest       ErrCode = "bad_request"
+	ErrUnauthorized     ErrCode = "unauthorized"
+	ErrForbidden        ErrCode = "forbidden"
+	ErrNotFound         ErrCode = "not_found"
+	ErrMethodNotAllowed ErrCode = "method_not_allowed"
+	ErrConflict         ErrCode = "conflict"
+	ErrTooManyRequests  ErrCode = "too_many_requests"
+	// ffprobe 获取视频信息失败
+	ErrProbeFailed ErrCode = "probe_failed"
+	// 生成缩略图, 封面和精灵图失败
+	ErrPreviewFailed ErrCode = "preview_failed"
+	// ffmpeg 获取帧, 生成联系表等失败
+	ErrMediaFailed ErrCode = "media_failed"
+	ErrInternal    ErrCode = "internal"
+)
+
+// 错误码对应的 http 状态码
+var errStatus = map[ErrCode]int{
+	ErrBadRequest:       http.StatusBadRequest,
+	ErrUnauthorized:     http.StatusUnauthorized,
+	ErrForbidden:        http.StatusForbidden,
+	ErrNotFound:         http.StatusNotFound,
+	ErrMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrConflict:         http.StatusConflict,
+	ErrTooManyRequests:  http.StatusTooManyRequests,
+	ErrProbeFailed:      http.StatusInternalServerError,
+	ErrPreviewFailed:    http.StatusInternalServerError,
+	ErrMediaFailed:      http.StatusInternalServerError,
+	ErrInternal:         http.StatusInternalServerError,
+}
+
+// 带错误码的错误, Msg 是中文的格式, 同时也是翻译的 key
+type CodeError struct {
+	Code ErrCode
+	Msg  string
+	Args []interface{}
+	// 原始错误, 只记录日志, 不返回给客户端
+	Err error
+}
+
+// 创建带错误码的错误, msg 可以带格式化参数
+func NewError(code ErrCode, msg string, args ...interface{}) *CodeError {
+	return &CodeError{Code: code, Msg: msg, Args: args}
+}
+
+// 给错误加上错误码, err 为 nil 时返回 nil
+func WrapError(err error, code ErrCode, msg string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &CodeError{Code: code, Msg: msg, Args: args, Err: err}
+}
+
+// 中文的错误信息
+func (e *CodeError) Message() string {
+	if len(e.Args) == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf(e.Msg, e.Args...)
+}
+
+func (e *CodeError) Error() string {
+	if e.Err != nil {
+		return e.Message() + ": " + e.Err.Error()
+	}
+	return e.Message()
+}
+
+func (e *CodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CodeError) Cause() error {
+	return e.Err
+}
+
+// %+v 时输出原始错误的堆栈
+func (e *CodeError) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') && e.Err != nil {
+		fmt.Fprintf(s, "%s: %+v", e.Message(), e.Err)
+		return
+	}
+	fmt.Fprint(s, e.Error())
+}
+
+// 错误的错误码, 没有错误码的是内部错误
+func CodeOf(err error) ErrCode {
+	var ce *CodeError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return ErrInternal
+}
+
+// 支持的语言, 第一个是默认语言
+var languages = []string{"zh", "en"}
+
+// 请求使用的语言, 按 Accept-Language 的权重选择支持的语言
+func requestLang(r *http.Request) string {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexAny(lang, "-_"); i >= 0 {
+			lang = lang[:i]
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if lang != "" && q > 0 {
+			tags = append(tags, tag{lang, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	for _, t := range tags {
+		for _, l := range languages {
+			if t.lang == l {
+				return l
+			}
+		}
+	}
+	return languages[0]
+}
+
+// 错误信息的翻译, 用中文的格式作为 key
+var translations = map[string]map[string]string{
+	"en": {
+		"请求格式错误":        "invalid request",
+		"请先登录":          "login required",
+		"需要管理员权限":       "administrator required",
+		"用户名或密码错误":      "invalid username or password",
+		"登录失败":          "login failed",
+		"登录失败次数太多":      "too many failed logins, try again later",
+		"不能删除自己":        "cannot delete yourself",
+		"旧密码错误":         "wrong old password",
+		"创建 token 失败":   "failed to create token",
+		"用户名不能为空":       "username is required",
+		"密码至少需要%d位":     "password must be at least %d characters",
+		"用户已存在: %v":     "user already exists: %v",
+		"用户不存在: %v":     "user not found: %v",
+		"token 不存在: %v": "token not found: %v",
+		"会话不存在":         "session not found",
+		"请求来源无法验证":      "request origin could not be verified",
+		"视频不存在":         "video not found",
+		"资源不存在":         "resource not found",
+		"不支持的请求方法":      "method not allowed",
+		"字幕不存在":         "subtitle not found",
+		"封面不存在":         "cover not found",
+		"封面还没有生成":       "cover not generated yet",
+		"预览还没有生成":       "preview not generated yet",
+		"预览生成中":         "preview is being generated",
+		"时间点错误":         "invalid time",
+		"宽度错误":          "invalid width",
+		"获取帧失败":         "failed to grab frame",
+		"联系表生成失败":       "failed to generate contact sheet",
+		"读取封面失败":        "failed to read cover",
+		"缩放封面失败":        "failed to resize cover",
+		"设置封面失败":        "failed to set cover",
+		"获取视频信息失败":      "failed to probe video",
+		"生成预览失败":        "failed to generate preview",
+		"规则的路径不能为空":     "rule path is required",
+		"PIN 至少需要%d位":   "PIN must be at least %d digits",
+		"PIN 错误":        "wrong PIN",
+		"PIN 错误次数太多":    "too many wrong PINs, try again later",
+		"只有登录的会话可以解锁":   "only login sessions can unlock",
+		"解锁失败":          "failed to unlock",
+		"记录播放位置失败":      "failed to save progress",
+		"标记失败":          "failed to mark video",
+		"收藏失败":          "failed to update favorite",
+		"设置标签失败":        "failed to set tags",
+		"只有添加标签的用户可以修改": "only the user who added the tags can edit them",
+		"合集不存在":         "collection not found",
+		"合集不存在: %v":     "collection not found: %v",
+		"合集名字不能为空":      "collection name is required",
+		"只有创建者可以修改合集":   "only the owner can edit this collection",
+		"视频不在合集中":       "video is not in the collection",
+		"不支持的排序: %v":    "unsupported sort: %v",
+		"数量限制错误: %v":    "invalid limit: %v",
+		"OR 两边都需要条件":    "OR needs conditions on both sides",
+		"不支持的条件: %v":    "unsupported condition: %v",
+		"条件的值错误: %v":    "invalid condition value: %v",
+		"播放列表不存在":       "playlist not found",
+		"播放列表不存在: %v":   "playlist not found: %v",
+		"播放列表名字不能为空":    "playlist name is required",
+		"生成播放列表失败":      "failed to generate playlist",
+		"有效期错误":         "invalid expiry",
+		"有效期错误: %v":     "invalid expiry: %v",
+		"次数限制错误: %v":    "invalid view limit: %v",
+		"分享不存在: %v":     "share not found: %v",
+		"分享不存在或已经过期":    "share not found or expired",
+		"分享的次数已经用完":     "share view limit reached",
+		"隐藏库中的视频不能分享":   "videos in the hidden library cannot be shared",
+		"服务器内部错误":       "internal server error",
+		// 没有翻译时使用错误码的通用信息
+		string(ErrBadRequest):       "bad request",
+		string(ErrUnauthorized):     "unauthorized",
+		string(ErrForbidden):        "forbidden",
+		string(ErrNotFound):         "not found",
+		string(ErrMethodNotAllowed): "method not allowed",
+		string(ErrConflict):         "conflict",
+		string(ErrTooManyRequests):  "too many requests",
+		string(ErrProbeFailed):      "failed to probe video",
+		string(ErrPreviewFailed):    "failed to generate preview",
+		string(ErrMediaFailed):      "failed to process video",
+		string(ErrInternal):         "internal server error",
+	},
+}
+
+// 翻译信息, 没有翻译时返回原来的中文
+func translate(lang, msg string) string {
+	if t, ok := translations[lang][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// 翻译错误信息, 没有翻译时使用错误码的通用信息
+func (e *CodeError) Localize(lang string) string {
+	if lang == languages[0] {
+		return e.Message()
+	}
+	format, ok := translations[lang][e.Msg]
+	if !ok {
+		return translations[lang][string(e.Code)]
+	}
+	if len(e.Args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, e.Args...)
+}
+
+// 路由没有匹配时也返回 json 错误
+func notFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, NewError(ErrNotFound, "资源不存在"))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, NewError(ErrMethodNotAllowed, "不支持的请求方法"))
+}
+
+// 写入错误, 状态码和错误码由错误决定, 没有错误码的错误记录日志后作为内部错误返回
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var ce *CodeError
+	if !errors.As(err, &ce) {
+		log.Printf("请求处理失败, %v %v: %+v", r.Method, r.URL.Path, err)
+		ce = NewError(ErrInternal, "服务器内部错误")
+	} else if ce.Err != nil {
+		log.Printf("请求处理失败, %v %v: %+v", r.Method, r.URL.Path, err)
+	}
+	status, ok := errStatus[ce.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	lang := requestLang(r)
+	w.Header().Set("Content-Language", lang)
+	WriteJsonStatus(w, status, &ResultCode{Code: -1, Error: ce.Code, Msg: ce.Localize(lang)})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		lang   string
+		status int
+		code   ErrCode
+		msg    string
+	}{
+		{"不存在", NewError(ErrNotFound, "视频不存在"), "", http.StatusNotFound, ErrNotFound, "视频不存在"},
+		{"英文", NewError(ErrNotFound, "合集不存在: %v", "c1"), "en-US,en;q=0.9", http.StatusNotFound, ErrNotFound, "collection not found: c1"},
+		{"包装后的错误", errors.WithMessage(NewError(ErrConflict, "用户已存在: %v", "bob"), "创建用户"), "", http.StatusConflict, ErrConflict, "用户已存在: bob"},
+		{"原始错误不返回", WrapError(errors.New("exit status 1"), ErrProbeFailed, "获取视频信息失败"), "", http.StatusInternalServerError, ErrProbeFailed, "获取视频信息失败"},
+		{"没有错误码", errors.New("disk full"), "en", http.StatusInternalServerError, ErrInternal, "internal server error"},
+		{"没有翻译", NewError(ErrForbidden, "没有翻译的信息"), "en", http.StatusForbidden, ErrForbidden, "forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(GET, "/videos/1", nil)
+			if tt.lang != "" {
+				r.Header.Set("Accept-Language", tt.lang)
+			}
+			w := httptest.NewRecorder()
+			WriteError(w, r, tt.err)
+			if w.Code != tt.status {
+				t.Errorf("status = %v, want %v", w.Code, tt.status)
+			}
+			var rc ResultCode
+			if err := json.Unmarshal(w.Body.Bytes(), &rc); err != nil {
+				t.Fatal(err)
+			}
+			if rc.Code != -1 || rc.Error != tt.code || rc.Msg != tt.msg {
+				t.Errorf("WriteError() = %+v, want %v %v", rc, tt.code, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRequestLang(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "zh"},
+		{"en", "en"},
+		{"zh-CN,zh;q=0.9,en;q=0.8", "zh"},
+		{"fr-FR,en;q=0.5,zh;q=0.3", "en"},
+		{"zh;q=0.2,en_GB;q=0.8", "en"},
+		{"en;q=0", "zh"},
+		{"fr", "zh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(GET, "/", nil)
+			r.Header.Set("Accept-Language", tt.header)
+			if got := requestLang(r); got != tt.want {
+				t.Errorf("requestLang() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeOf(t *testing.T) {
+	err := errors.WithStack(WrapError(errors.New("eof"), ErrProbeFailed, "获取视频信息失败"))
+	if got := CodeOf(err); got != ErrProbeFailed {
+		t.Errorf("CodeOf() = %v, want %v", got, ErrProbeFailed)
+	}
+	if got := CodeOf(errors.New("eof")); got != ErrInternal {
+		t.Errorf("CodeOf() = %v, want %v", got, ErrInternal)
+	}
+	if WrapError(nil, ErrInternal, "失败") != nil {
+		t.Errorf("WrapError(nil) 应该返回 nil")
+	}
+}
+
+// 所有错误信息都需要有翻译
+func TestTranslations(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`(?:NewError\(|WrapError\([^,]+,)\s*Err\w+,\s*"([^"]*)"`)
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range re.FindAllStringSubmatch(string(data), -1) {
+			for lang, msgs := range translations {
+				if _, ok := msgs[m[1]]; !ok {
+					t.Errorf("%v: %q 没有 %v 翻译", f, m[1], lang)
+				}
+			}
+		}
+	}
+}
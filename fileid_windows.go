@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// windows 的文件信息里没有文件索引, 使用解析链接后的真实路径
+func fileIdentity(path string, info os.FileInfo) (fileID, bool) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fileID{}, false
+	}
+	return fileID{path: real}, true
+}
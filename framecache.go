@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 磁盘上的帧缓存, 超过大小限制时删除最久没有使用的
+type FrameCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type frameCacheEntry struct {
+	key  string
+	size int64
+}
+
+// 创建帧缓存, 加载目录中已有的文件, 按修改时间作为最近使用时间
+func NewFrameCache(dir string, limit int64) (*FrameCache, error) {
+	c := &FrameCache{dir: dir, limit: limit, lru: list.New(), entries: map[string]*list.Element{}}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		c.entries[f.Name()] = c.lru.PushBack(&frameCacheEntry{key: f.Name(), size: f.Size()})
+		c.size += f.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// 缓存文件的路径
+func (c *FrameCache) Path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// 获取缓存, 返回文件路径
+func (c *FrameCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	// 重启后按修改时间恢复使用顺序
+	now := time.Now()
+	os.Chtimes(c.Path(key), now, now)
+	return c.Path(key), true
+}
+
+// 文件已经写入 Path(key) 后, 加入缓存
+func (c *FrameCache) Put(key string) error {
+	fi, err := os.Stat(c.Path(key))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*frameCacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&frameCacheEntry{key: key, size: fi.Size()})
+	c.size += fi.Size()
+	c.evict()
+	return nil
+}
+
+// 删除最久没有使用的, 直到不超过大小限制
+func (c *FrameCache) evict() {
+	for c.limit > 0 && c.size > c.limit && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		entry := e.Value.(*frameCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(c.Path(entry.key))
+	}
+}
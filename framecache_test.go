@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFrameCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frames")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewFrameCache(dir, 25)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	put := func(key string) {
+		if err := ioutil.WriteFile(c.Path(key), make([]byte, 10), os.ModePerm); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := c.Put(key); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	put("a")
+	put("b")
+	// 访问 a 之后, b 是最久没有使用的
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("a 应该在缓存中")
+	}
+	put("c")
+
+	if _, ok := c.Get("b"); ok || IsFileExists(c.Path("b")) {
+		t.Errorf("b 应该被删除")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%v 应该在缓存中", key)
+		}
+	}
+
+	// 重新加载已有的文件
+	c, err = NewFrameCache(dir, 15)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("重新加载后应该只剩一个, got %d", c.lru.Len())
+	}
+}
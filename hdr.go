@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// HDR 的类型
+const (
+	HDR10 = "hdr10"
+	HLG   = "hlg"
+)
+
+// 根据传输特性判断 HDR 类型, 不是 HDR 返回空字符串
+func hdrType(colorTransfer string) string {
+	switch colorTransfer {
+	case "smpte2084":
+		return HDR10
+	case "arib-std-b67":
+		return HLG
+	}
+	return ""
+}
+
+// 把 HDR 转换到 SDR 的 bt709 的过滤器
+const toneMapChain = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// HDR 视频的色调映射过滤器, 不是 HDR 或者 ffmpeg 不支持 zscale 时返回空字符串
+func ToneMapFilter(ffmpeg string, v *Video) string {
+	if v.HDR == "" {
+		return ""
+	}
+	if !HasFilter(ffmpeg, "zscale") || !HasFilter(ffmpeg, "tonemap") {
+		toneMapWarning.Do(func() {
+			log.Printf("ffmpeg 不支持 zscale 或 tonemap, HDR 视频不做色调映射")
+		})
+		return ""
+	}
+	return toneMapChain
+}
+
+// 在过滤器后面加上色调映射
+func withToneMap(vf, toneMap string) string {
+	if toneMap == "" {
+		return vf
+	}
+	if vf == "" {
+		return toneMap
+	}
+	return vf + "," + toneMap
+}
+
+var (
+	filters   = map[string]map[string]bool{}
+	filtersMu sync.Mutex
+	// 不支持色调映射只提示一次
+	toneMapWarning sync.Once
+)
+
+// ffmpeg 是否支持指定的过滤器, 每个 ffmpeg 只查询一次
+func HasFilter(ffmpeg, filter string) bool {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	supported, ok := filters[ffmpeg]
+	if !ok {
+		supported = map[string]bool{}
+		if out, err := exec.Command(ffmpeg, "-hide_banner", "-filters").Output(); err == nil {
+			for _, line := range strings.Split(string(out), "\n") {
+				if fields := strings.Fields(line); len(fields) >= 2 {
+					supported[fields[1]] = true
+				}
+			}
+		}
+		filters[ffmpeg] = supported
+	}
+	return supported[filter]
+}
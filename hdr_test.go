@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestToneMapFilter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("需要 shell 脚本模拟 ffmpeg")
+	}
+	dir, err := ioutil.TempDir("", "hdr")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 模拟不同编译选项的 ffmpeg
+	fake := func(name, filters string) string {
+		p := filepath.Join(dir, name)
+		script := "#!/bin/sh\necho 'Filters:'\necho ' T.. = Timeline support'\necho '" + filters + "'\n"
+		if err := ioutil.WriteFile(p, []byte(script), 0755); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return p
+	}
+	full := fake("ffmpeg-full", " ..C zscale  V->V  Apply resizing\n ... tonemap  V->V  Conversion to/from different dynamic ranges.")
+	noZscale := fake("ffmpeg-lite", " ... tonemap  V->V  Conversion to/from different dynamic ranges.")
+
+	hdr := &Video{HDR: hdrType("smpte2084")}
+	hlg := &Video{HDR: hdrType("arib-std-b67")}
+	sdr := &Video{HDR: hdrType("bt709")}
+
+	if got := ToneMapFilter(full, hdr); got != toneMapChain {
+		t.Errorf("HDR10 应该色调映射, got %q", got)
+	}
+	if got := ToneMapFilter(full, hlg); got != toneMapChain {
+		t.Errorf("HLG 应该色调映射, got %q", got)
+	}
+	if got := ToneMapFilter(full, sdr); got != "" {
+		t.Errorf("SDR 不需要色调映射, got %q", got)
+	}
+	if got := ToneMapFilter(noZscale, hdr); got != "" {
+		t.Errorf("不支持 zscale 时不做色调映射, got %q", got)
+	}
+
+	if got := withToneMap("fps=1/5", toneMapChain); got != "fps=1/5,"+toneMapChain {
+		t.Errorf("withToneMap() = %q", got)
+	}
+	if got := withToneMap("fps=1/5", ""); got != "fps=1/5" {
+		t.Errorf("withToneMap() = %q", got)
+	}
+}
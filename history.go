@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 播放到这个比例就算看完了, 片尾通常不会看
+const watchedRatio = 0.9
+
+// 列表默认返回的数量
+const defaultHistoryLimit = 20
+
+// 播放位置不马上保存, 每隔这么久保存一次
+const historyFlushInterval = 10 * time.Second
+
+// 用户观看视频的状态
+type WatchState struct {
+	// 继续播放的位置, 看完后清零
+	Position time.Duration `json:"position"`
+	Watched  bool          `json:"watched"`
+	Updated  time.Time     `json:"updated"`
+}
+
+// 观看记录, 和视频信息缓存放在一起
+type historyStore struct {
+	mu   sync.RWMutex
+	path string
+	// 有没有保存的修改
+	dirty bool
+
+	// 用户 -> 视频id -> 状态
+	Users map[string]map[string]*WatchState `json:"users"`
+}
+
+var history = newHistoryStore("")
+
+func newHistoryStore(path string) *historyStore {
+	return &historyStore{path: path, Users: map[string]map[string]*WatchState{}}
+}
+
+// 读取观看记录, 文件不存在时为空
+func LoadHistory(path string) error {
+	s := newHistoryStore(path)
+	if IsFileExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取观看记录失败")
+		}
+		if err = json.Unmarshal(data, s); err != nil {
+			return errors.WithMessage(err, "解析观看记录失败")
+		}
+	}
+	history = s
+	return nil
+}
+
+// 保存观看记录, 调用时需要持有锁
+func (s *historyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := saveJSON(s.path, s, "观看记录"); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// 保存没有保存的修改
+func (s *historyStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// 定期保存播放位置, 退出时由 Stop 保存最后的修改
+func flushHistory() {
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := history.Flush(); err != nil {
+			log.Printf("观看记录保存失败: %+v", err)
+		}
+	}
+}
+
+// 用户观看视频的状态, 没有看过返回零值
+func (s *historyStore) Get(user, id string) WatchState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if st := s.Users[user][id]; st != nil {
+		return *st
+	}
+	return WatchState{}
+}
+
+// 修改观看状态, later 为 true 时只标记修改, 之后定期保存
+func (s *historyStore) update(user, id string, later bool, fn func(st *WatchState)) (WatchState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := s.Users[user]
+	if states == nil {
+		states = map[string]*WatchState{}
+		s.Users[user] = states
+	}
+	st := states[id]
+	if st == nil {
+		st = &WatchState{}
+		states[id] = st
+	}
+	fn(st)
+	st.Updated = time.Now()
+	if later {
+		s.dirty = true
+		return *st, nil
+	}
+	return *st, s.save()
+}
+
+// 记录播放位置, 超过 watchedRatio 标记为看完, 播放时会频繁调用, 不马上保存
+func (s *historyStore) Report(user string, v *Video, position time.Duration) (WatchState, error) {
+	return s.update(user, v.ID, true, func(st *WatchState) {
+		if v.Duration > 0 && float64(position) >= float64(v.Duration)*watchedRatio {
+			st.Watched = true
+			st.Position = 0
+			return
+		}
+		st.Position = position
+	})
+}
+
+// 手动标记是否看完, 都会清除播放位置
+func (s *historyStore) SetWatched(user, id string, watched bool) (WatchState, error) {
+	return s.update(user, id, false, func(st *WatchState) {
+		st.Watched = watched
+		st.Position = 0
+	})
+}
+
+// 删除用户的观看记录
+func (s *historyStore) DeleteUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Users, user)
+	return s.save()
+}
+
+// 带有用户观看状态的视频
+type UserVideo struct {
+	*Video
+	Position time.Duration `json:"position"`
+	Watched  bool          `json:"watched"`
+	Updated  time.Time     `json:"updated"`
+	Favorite bool          `json:"favorite"`
+	Tags     []string      `json:"tags"`
+}
+
+// 给视频加上用户的观看状态
+func (s *historyStore) UserVideos(user string, videos []*Video) []*UserVideo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	states := s.Users[user]
+	res := make([]*UserVideo, len(videos))
+	for i, v := range videos {
+		res[i] = &UserVideo{Video: v}
+		if st := states[v.ID]; st != nil {
+			res[i].Position = st.Position
+			res[i].Watched = st.Watched
+			res[i].Updated = st.Updated
+		}
+	}
+	return res
+}
+
+// 继续观看, 看了一部分还没有看完的, 最近看的在前面
+func ContinueWatching(videos []*UserVideo) []*UserVideo {
+	var res []*UserVideo
+	for _, v := range videos {
+		if v.Position > 0 && !v.Watched {
+			res = append(res, v)
+		}
+	}
+	sortByUpdated(res)
+	return res
+}
+
+// 最近观看, 包括看完的, 最近看的在前面
+func RecentlyWatched(videos []*UserVideo) []*UserVideo {
+	var res []*UserVideo
+	for _, v := range videos {
+		if !v.Updated.IsZero() {
+			res = append(res, v)
+		}
+	}
+	sortByUpdated(res)
+	return res
+}
+
+// 没有看完的视频
+func Unwatched(videos []*UserVideo) []*UserVideo {
+	var res []*UserVideo
+	for _, v := range videos {
+		if !v.Watched {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func sortByUpdated(videos []*UserVideo) {
+	sort.SliceStable(videos, func(i, j int) bool {
+		return videos[i].Updated.After(videos[j].Updated)
+	})
+}
+
+// 当前用户可以访问的视频, 带有观看状态, 收藏和标签
+func currentUserVideos(r *http.Request) []*UserVideo {
+	name := CurrentUser(r).Name
+	videos := history.UserVideos(name, accessibleVideos(r, Videos()))
+	organize.Annotate(name, videos)
+	return videos
+}
+
+// 请求的数量限制, n 参数, 默认 defaultHistoryLimit
+func historyLimit(r *http.Request, videos []*UserVideo) []*UserVideo {
+	n := defaultHistoryLimit
+	if s := r.URL.Query().Get("n"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			n = v
+		}
+	}
+	if len(videos) > n {
+		return videos[:n]
+	}
+	return videos
+}
+
+// 上报播放位置, position 为秒
+func ReportProgress(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	req := struct {
+		Position float64 `json:"position"`
+	}{}
+	if err := readJson(r, &req); err != nil || req.Position < 0 {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	st, err := history.Report(CurrentUser(r).Name, v, seconds(req.Position))
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "记录播放位置失败"))
+		return
+	}
+	OkCode(w, st)
+}
+
+// 标记是否看完
+func SetWatched(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	req := struct {
+		Watched bool `json:"watched"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	st, err := history.SetWatched(CurrentUser(r).Name, v.ID, req.Watched)
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "标记失败"))
+		return
+	}
+	OkCode(w, st)
+}
+
+// 获取继续观看的列表
+func GetContinueWatching(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, historyLimit(r, ContinueWatching(currentUserVideos(r))))
+}
+
+// 获取最近观看的列表
+func GetRecentlyWatched(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, historyLimit(r, RecentlyWatched(currentUserVideos(r))))
+}
+
+// 获取没有看完的列表
+func GetUnwatched(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, Unwatched(currentUserVideos(r)))
+}
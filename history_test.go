@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryReport(t *testing.T) {
+	v := &Video{ID: "v1", Duration: 100 * time.Second}
+	tests := []struct {
+		name     string
+		position time.Duration
+		want     WatchState
+	}{
+		{"开始播放", 10 * time.Second, WatchState{Position: 10 * time.Second}},
+		{"快看完了", 89 * time.Second, WatchState{Position: 89 * time.Second}},
+		{"看完了", 90 * time.Second, WatchState{Watched: true}},
+		{"看完后重新播放", 5 * time.Second, WatchState{Position: 5 * time.Second, Watched: true}},
+	}
+	s := newHistoryStore("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Report("alice", v, tt.position)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if got.Position != tt.want.Position || got.Watched != tt.want.Watched {
+				t.Errorf("Report() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if st := s.Get("bob", "v1"); st.Position != 0 || st.Watched {
+		t.Errorf("Get() 其他用户 = %+v", st)
+	}
+}
+
+func TestHistoryLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	videos := []*Video{
+		{ID: "a", Duration: time.Hour},
+		{ID: "b", Duration: time.Hour},
+		{ID: "c", Duration: time.Hour},
+		{ID: "d", Duration: time.Hour},
+	}
+	s := newHistoryStore(file)
+	s.Report("alice", videos[0], time.Minute)
+	s.SetWatched("alice", "b", true)
+	s.Report("alice", videos[2], 2*time.Minute)
+	// 播放位置定期保存, 读取前先保存
+	if err := s.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("临时文件应该已经改名")
+	}
+
+	// 重新读取
+	if err := LoadHistory(file); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	uvs := history.UserVideos("alice", videos)
+
+	ids := func(vs []*UserVideo) []string {
+		var res []string
+		for _, v := range vs {
+			res = append(res, v.ID)
+		}
+		return res
+	}
+	tests := []struct {
+		name string
+		got  []*UserVideo
+		want []string
+	}{
+		{"继续观看", ContinueWatching(uvs), []string{"c", "a"}},
+		{"最近观看", RecentlyWatched(uvs), []string{"c", "b", "a"}},
+		{"没有看完", Unwatched(uvs), []string{"a", "c", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(tt.got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// 观看状态和视频信息在同一层
+	data, _ := json.Marshal(uvs[0])
+	m := map[string]interface{}{}
+	json.Unmarshal(data, &m)
+	if m["id"] != "a" || m["position"] != float64(time.Minute) || m["watched"] != false {
+		t.Errorf("json = %s", data)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 图片格式
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	// 需要 ffmpeg 支持 libwebp
+	FormatWebp = "webp"
+)
+
+// 图片输出配置, 零值是质量80的 jpeg
+type ImageOutput struct {
+	Format string
+	// 质量, 1~100, png 忽略
+	Quality int
+	// 缩放使用的插值算法, 默认 NearestNeighbor
+	Filter resize.InterpolationFunction
+	// 缩略图和格子比例不同时的填充色, 默认黑色
+	Letterbox color.Color
+	// 编码 webp 使用的 ffmpeg
+	FFmpeg string
+}
+
+// 文件扩展名
+func (o ImageOutput) Ext() string {
+	switch o.Format {
+	case FormatPng:
+		return ".png"
+	case FormatWebp:
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// 根据文件扩展名判断图片格式
+func imageFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return FormatPng
+	case ".webp":
+		return FormatWebp
+	default:
+		return FormatJpeg
+	}
+}
+
+func (o ImageOutput) quality() int {
+	if o.Quality <= 0 || o.Quality > 100 {
+		return 80
+	}
+	return o.Quality
+}
+
+func (o ImageOutput) letterbox() color.Color {
+	if o.Letterbox == nil {
+		return color.Black
+	}
+	return o.Letterbox
+}
+
+// 保存图片
+func (o ImageOutput) Write(img image.Image, out string) error {
+	if o.Format == FormatWebp {
+		return o.writeWebp(img, out)
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	switch o.Format {
+	case FormatPng:
+		err = png.Encode(f, img)
+	default:
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: o.quality()})
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// 标准库没有 webp 编码, 把 png 通过管道交给 ffmpeg 编码
+func (o ImageOutput) writeWebp(img image.Image, out string) error {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cmd := exec.Command(o.FFmpeg, "-hide_banner", "-v", "error", "-y", "-f", "png_pipe", "-i", "pipe:0",
+		"-c:v", "libwebp", "-quality", strconv.Itoa(o.quality()), out)
+	cmd.Stdin = &buf
+	_, err = cmd.Output()
+	if err != nil {
+		return execError(cmd, err)
+	}
+	return nil
+}
+
+// ffmpeg 是否支持指定的编码器
+func HasEncoder(ffmpeg, encoder string) bool {
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == encoder {
+			return true
+		}
+	}
+	return false
+}
+
+// 插值算法的名字
+var resizeFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// 解析插值算法的名字
+func ParseResizeFilter(name string) (resize.InterpolationFunction, error) {
+	filter, ok := resizeFilters[strings.ToLower(name)]
+	if !ok {
+		return 0, errors.Errorf("不支持的缩放算法: %v", name)
+	}
+	return filter, nil
+}
+
+// 解析 #rrggbb 格式的颜色
+func ParseHexColor(s string) (color.Color, error) {
+	var c color.RGBA
+	c.A = 0xff
+	_, err := fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil {
+		return nil, errors.Errorf("颜色格式错误: %v", s)
+	}
+	return c, nil
+}
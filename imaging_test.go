@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHexColor(t *testing.T) {
+	c, err := ParseHexColor("#1a2B3c")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if c != (color.RGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff}) {
+		t.Errorf("ParseHexColor() = %v", c)
+	}
+	if _, err := ParseHexColor("red"); err == nil {
+		t.Errorf("ParseHexColor() 应该返回错误")
+	}
+}
+
+func TestParseResizeFilter(t *testing.T) {
+	if f, err := ParseResizeFilter("Lanczos3"); err != nil || f != resize.Lanczos3 {
+		t.Errorf("ParseResizeFilter() = %v, %v", f, err)
+	}
+	if _, err := ParseResizeFilter("box"); err == nil {
+		t.Errorf("ParseResizeFilter() 应该返回错误")
+	}
+}
+
+func TestComposeSpriteOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaging")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 竖的缩略图放在横的格子里, 两边填充
+	thumb := image.NewRGBA(image.Rect(0, 0, 10, 20))
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	letterbox := color.RGBA{R: 0xff, A: 0xff}
+	output := ImageOutput{Format: FormatPng, Filter: resize.Bilinear, Letterbox: letterbox}
+
+	out := filepath.Join(dir, "thumbs"+output.Ext())
+	sprite, err := composeSprite(1, func(dst draw.Image, r image.Rectangle, i int) error {
+		drawThumbImage(dst, r, thumb, output.Filter)
+		return nil
+	}, out, 40, 20, 1, 1, output)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	img, err := decodeImage(sprite.Path)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := color.RGBAModel.Convert(img.At(0, 10)); got != letterbox {
+		t.Errorf("填充色 = %v, want %v", got, letterbox)
+	}
+	if got := color.RGBAModel.Convert(img.At(20, 10)); got != (color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}) {
+		t.Errorf("缩略图颜色 = %v", got)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 忽略文件的名字, 放在库的任意目录中, 对该目录及子目录生效
+const ignoreFileName = ".nightignore"
+
+// 视频库
+type Library struct {
+	// 根目录
+	Dir string `json:"dir"`
+	// 包含的文件模式, 为空包含所有文件
+	Include []string `json:"include"`
+	// 排除的文件或目录模式
+	Exclude []string `json:"exclude"`
+	// 隐藏的库, 需要输入 PIN 解锁后才能看到
+	Hidden bool `json:"hidden"`
+}
+
+// 解析命令行中的库, 格式为 目录;include=模式,模式;exclude=模式,模式
+// 没有指定 include 或 exclude 时使用 include 和 exclude 参数
+func ParseLibrary(spec string, include, exclude []string, hidden bool) (*Library, error) {
+	parts := strings.Split(spec, ";")
+	lib := &Library{Dir: strings.TrimSpace(parts[0]), Include: include, Exclude: exclude, Hidden: hidden}
+	if lib.Dir == "" {
+		return nil, errors.Errorf("库的目录不能为空: %v", spec)
+	}
+	for _, part := range parts[1:] {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, errors.Errorf("库的选项格式错误: %v", part)
+		}
+		switch key := strings.TrimSpace(part[:i]); key {
+		case "include":
+			lib.Include = splitList(part[i+1:])
+		case "exclude":
+			lib.Exclude = splitList(part[i+1:])
+		default:
+			return nil, errors.Errorf("不支持的库选项: %v", key)
+		}
+	}
+	return lib, nil
+}
+
+// 忽略规则
+type ignoreRule struct {
+	pattern string
+	// 以 ! 开头, 重新包含
+	negate bool
+	// 以 / 结尾, 只匹配目录
+	dirOnly bool
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	rule.pattern = line
+	return rule, line != ""
+}
+
+// 读取忽略文件
+func readIgnoreFile(file string) ([]ignoreRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if rule, ok := parseIgnoreRule(s.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, s.Err()
+}
+
+// 匹配模式, 包含 / 的模式匹配相对路径, 否则只匹配文件名
+func matchPattern(pattern, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), rel)
+		return ok
+	}
+	ok, _ := path.Match(pattern, path.Base(rel))
+	return ok
+}
+
+// 库的扫描过滤器
+type libraryFilter struct {
+	lib *Library
+	// 目录 -> 该目录下忽略文件的规则
+	ignores map[string][]ignoreRule
+}
+
+func newLibraryFilter(lib *Library) *libraryFilter {
+	return &libraryFilter{lib: lib, ignores: map[string][]ignoreRule{}}
+}
+
+// 进入目录时加载目录下的忽略文件
+func (f *libraryFilter) EnterDir(dir string) error {
+	file := filepath.Join(dir, ignoreFileName)
+	if !IsFileExists(file) {
+		return nil
+	}
+	rules, err := readIgnoreFile(file)
+	if err != nil {
+		return err
+	}
+	f.ignores[dir] = rules
+	return nil
+}
+
+// 是否被排除
+func (f *libraryFilter) Excluded(p string, isDir bool) bool {
+	root := filepath.Clean(f.lib.Dir)
+	p = filepath.Clean(p)
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+
+	excluded := false
+	for _, pattern := range f.lib.Exclude {
+		if matchPattern(pattern, rel) {
+			excluded = true
+			break
+		}
+	}
+
+	// 从根目录开始逐级应用忽略文件, 后匹配的规则优先
+	var dirs []string
+	for d := filepath.Dir(p); d != root && strings.HasPrefix(d, root); d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+	}
+	dirs = append(dirs, root)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		rules := f.ignores[d]
+		if len(rules) == 0 {
+			continue
+		}
+		r, err := filepath.Rel(d, p)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if matchPattern(rule.pattern, r) {
+				excluded = !rule.negate
+			}
+		}
+	}
+	return excluded
+}
+
+// 文件是否被包含
+func (f *libraryFilter) Included(p string) bool {
+	if len(f.lib.Include) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(f.lib.Dir, p)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range f.lib.Include {
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// 库的根目录是否在线, 根目录存在且不为空
+// 未挂载的挂载点通常是一个空目录, 也视为离线
+func IsLibraryOnline(dir string) bool {
+	if !IsDir(dir) {
+		return false
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	return len(names) > 0
+}
+
+// 路径是否是目录本身或者在目录下
+func isWithin(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// 查找路径所属的库, 有多个时取最深的那个
+func FindLibrary(libs []*Library, p string) *Library {
+	var found *Library
+	for _, lib := range libs {
+		if !isWithin(lib.Dir, p) {
+			continue
+		}
+		if found == nil || len(lib.Dir) > len(found.Dir) {
+			found = lib
+		}
+	}
+	return found
+}
+
+// 库的状态
+type LibraryStatus struct {
+	Dir     string    `json:"dir"`
+	Online  bool      `json:"online"`
+	Checked time.Time `json:"checked"`
+}
+
+var (
+	libraryStatus   []*LibraryStatus
+	libraryStatusMu sync.RWMutex
+)
+
+// 检查并记录库的在线状态
+func CheckLibraries(libs []*Library) map[string]bool {
+	online := make(map[string]bool, len(libs))
+	status := make([]*LibraryStatus, len(libs))
+	now := time.Now()
+	for i, lib := range libs {
+		online[lib.Dir] = IsLibraryOnline(lib.Dir)
+		status[i] = &LibraryStatus{Dir: lib.Dir, Online: online[lib.Dir], Checked: now}
+	}
+	libraryStatusMu.Lock()
+	libraryStatus = status
+	libraryStatusMu.Unlock()
+	return online
+}
+
+// 所有库的状态
+func Libraries() []*LibraryStatus {
+	libraryStatusMu.RLock()
+	defer libraryStatusMu.RUnlock()
+	return libraryStatus
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLibraryFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	sub := filepath.Join(root, "movies")
+	if err := os.MkdirAll(sub, os.ModePerm); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ioutil.WriteFile(filepath.Join(root, ignoreFileName), []byte("# 注释\nsample/\n*.iso\n"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(sub, ignoreFileName), []byte("!keep.iso\n"), os.ModePerm)
+
+	f := newLibraryFilter(&Library{Dir: root, Include: []string{"*.mkv", "*.iso"}, Exclude: []string{"extras"}})
+	if err := f.EnterDir(root); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := f.EnterDir(sub); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+		included bool
+	}{
+		{path: root, isDir: true, excluded: false},
+		{path: filepath.Join(root, "sample"), isDir: true, excluded: true},
+		{path: filepath.Join(root, "sample"), isDir: false, excluded: false, included: false},
+		{path: filepath.Join(root, "extras"), isDir: true, excluded: true},
+		{path: filepath.Join(root, "a.iso"), excluded: true, included: true},
+		{path: filepath.Join(sub, "keep.iso"), excluded: false, included: true},
+		{path: filepath.Join(sub, "a.mkv"), excluded: false, included: true},
+		{path: filepath.Join(sub, "a.mp4"), excluded: false, included: false},
+	}
+	for _, tt := range tests {
+		if got := f.Excluded(tt.path, tt.isDir); got != tt.excluded {
+			t.Errorf("Excluded(%v, %v) = %v, want %v", tt.path, tt.isDir, got, tt.excluded)
+		}
+		if tt.isDir {
+			continue
+		}
+		if got := f.Included(tt.path); got != tt.included {
+			t.Errorf("Included(%v) = %v, want %v", tt.path, got, tt.included)
+		}
+	}
+}
+
+func TestParseLibrary(t *testing.T) {
+	include, exclude := []string{"*.mkv"}, []string{"sample"}
+	tests := []struct {
+		spec    string
+		want    Library
+		wantErr bool
+	}{
+		{"/media/tv", Library{Dir: "/media/tv", Include: include, Exclude: exclude}, false},
+		{"/media/movies;include=*.mp4, *.avi", Library{Dir: "/media/movies", Include: []string{"*.mp4", "*.avi"}, Exclude: exclude}, false},
+		{"/media/home;exclude=*.part;include=", Library{Dir: "/media/home", Exclude: []string{"*.part"}}, false},
+		{"/media/tv;depth=1", Library{}, true},
+		{"/media/tv;include", Library{}, true},
+		{";include=*.mkv", Library{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseLibrary(tt.spec, include, exclude, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLibrary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tt.want.Hidden = true
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseLibrary() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLibraryOnline(t *testing.T) {
+	root, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	empty := filepath.Join(root, "empty")
+	os.MkdirAll(empty, os.ModePerm)
+	mounted := filepath.Join(root, "mounted")
+	os.MkdirAll(mounted, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(mounted, "a.mp4"), []byte{}, os.ModePerm)
+	file := filepath.Join(mounted, "a.mp4")
+
+	tests := []struct {
+		name string
+		dir  string
+		want bool
+	}{
+		{"不存在", filepath.Join(root, "missing"), false},
+		{"空的挂载点", empty, false},
+		{"有文件", mounted, true},
+		{"是文件", file, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLibraryOnline(tt.dir); got != tt.want {
+				t.Errorf("IsLibraryOnline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
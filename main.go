@@ -3,29 +3,118 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "contactsheet" {
+		contactSheetMain(os.Args[2:])
+		return
+	}
+
 	port := flag.Int("p", 8080, "http端口")
-	dir := flag.String("d", "", "扫描目录")
+	var dirs listFlag
+	flag.Var(&dirs, "d", "扫描目录, 可以指定多次, 可以带上这个库的模式, 如 /media/tv;include=*.mkv;exclude=sample")
+	var hiddenDirs listFlag
+	flag.Var(&hiddenDirs, "hidden", "隐藏的扫描目录, 输入 PIN 解锁后才能看到, 可以指定多次, 格式和 -d 一样")
 	cacheDir := flag.String("c", "", "缓存目录")
 	ffprobe := flag.String("ffprobe", "ffprobe", "ffprobe")
 	ffmpeg := flag.String("ffmpeg", "ffmpeg", "ffmpeg")
+	include := flag.String("include", "", "默认包含的文件模式, 逗号分隔, 如 *.mkv,*.mp4, 库指定了 include 时不使用")
+	exclude := flag.String("exclude", "", "默认排除的文件或目录模式, 逗号分隔, 如 *.part,sample, 库指定了 exclude 时不使用")
+	probe := flag.Bool("probe", false, "使用ffprobe确认视频文件")
+	follow := flag.Bool("follow", false, "扫描时跟随符号链接")
+	maxDepth := flag.Int("max-depth", 0, "扫描时最多进入几层子目录, 0 不限制")
+	previewMode := flag.String("preview-mode", PreviewUniform, "缩略图采样方式, uniform 均匀采样, scene 按场景变化采样")
+	sceneThreshold := flag.Float64("scene-threshold", 0.3, "场景变化的阈值, 0~1")
+	pipe := flag.Bool("pipe", false, "通过管道读取帧生成预览, 不写临时缩略图")
+	imageFormat := flag.String("image-format", FormatJpeg, "封面和精灵图的格式, jpeg, png, webp")
+	imageQuality := flag.Int("image-quality", 80, "封面和精灵图的质量, 1~100")
+	resizeFilter := flag.String("resize-filter", "lanczos3", "缩略图缩放算法, nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3")
+	letterbox := flag.String("letterbox", "#000000", "缩略图比例不同时的填充色")
+	grace := flag.Duration("grace", 72*time.Hour, "库在线时, 视频文件不存在多久后移除视频信息")
+	checkInterval := flag.Duration("check-interval", 5*time.Minute, "多久检查一次库是否在线, 重新在线的库会重新扫描, 0 只在启动时检查")
+	fontFile := flag.String("font", "", "联系表使用的字体文件, 为空使用内置字体")
+	coverOrder := flag.String("cover-order", strings.Join(DefaultCoverOrder, ","), "封面来源的顺序, sidecar 视频旁边的图片, embedded 内嵌封面, frame 视频中的帧")
+	frameCache := flag.Int64("frame-cache", 256, "帧和缩放封面缓存的大小限制, 单位MB")
+	tlsOn := flag.Bool("tls", false, "使用 https, 没有指定证书时在缓存目录生成自签名证书")
+	tlsCert := flag.String("tls-cert", "", "https 证书文件, 指定后自动使用 https, 收到 SIGHUP 时重新读取")
+	tlsKey := flag.String("tls-key", "", "https 私钥文件")
+	redirectPort := flag.Int("http-redirect", 0, "http 跳转到 https 的端口, 0 不跳转")
+	var allowOrigins listFlag
+	flag.Var(&allowOrigins, "allow-origin", "允许跨域访问的来源, 如 https://example.com, * 允许所有来源但是不带 cookie, 可以指定多次")
 	flag.Parse()
 
-	go Start(*port)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("参数错误: -tls-cert 和 -tls-key 需要一起指定")
+	}
+	if *redirectPort > 0 && !*tlsOn && *tlsCert == "" {
+		log.Fatalf("参数错误: -http-redirect 需要使用 https, 指定 -tls 或 -tls-cert")
+	}
+
+	var libs []*Library
+	for i, spec := range append(dirs, hiddenDirs...) {
+		lib, err := ParseLibrary(spec, splitList(*include), splitList(*exclude), i >= len(dirs))
+		if err != nil {
+			log.Fatalf("参数错误: %v", err)
+		}
+		libs = append(libs, lib)
+	}
+	output := imageOutput(*ffmpeg, *imageFormat, *imageQuality, *resizeFilter, *letterbox)
+	order, err := ParseCoverOrder(splitList(*coverOrder))
+	if err != nil {
+		log.Fatalf("参数错误: %v", err)
+	}
+
+	sc := ScanConfig{
+		Detector:       &VideoDetector{},
+		PurgeGrace:     *grace,
+		CheckInterval:  *checkInterval,
+		FollowSymlinks: *follow,
+		MaxDepth:       *maxDepth,
+		PreviewMode:    *previewMode,
+		SceneThreshold: *sceneThreshold,
+		PipeFrames:     *pipe,
+		ImageOutput:    output,
+		CoverOrder:     order,
+	}
+	if *probe {
+		sc.Detector.FFprobe = *ffprobe
+	}
 
-	go ScanVideos([]string{*dir}, *cacheDir, *ffprobe, *ffmpeg)
+	go Start(ServerConfig{
+		Port:           *port,
+		CacheDir:       *cacheDir,
+		FFprobe:        *ffprobe,
+		FFmpeg:         *ffmpeg,
+		ContactSheet:   ContactSheetConfig{Output: output, FontFile: *fontFile},
+		ImageOutput:    output,
+		FrameCacheSize: *frameCache << 20,
+		Libraries:      libs,
+		TLS:            *tlsOn || *tlsCert != "",
+		TLSCert:        *tlsCert,
+		TLSKey:         *tlsKey,
+		RedirectPort:   *redirectPort,
+		AllowOrigins:   allowOrigins,
+	})
+
+	go ScanLibraries(libs, *cacheDir, *ffprobe, *ffmpeg, sc)
 
 	// 等待退出
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
-	<-c
+	// SIGHUP 重新读取证书, 不退出
+	for s := <-c; s == syscall.SIGHUP; s = <-c {
+		ReloadCertificate()
+	}
 
 	// 停止正在运行的服务
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -49,3 +138,91 @@ func main() {
 
 	wg.Wait()
 }
+
+// 生成联系表的子命令
+func contactSheetMain(args []string) {
+	fs := flag.NewFlagSet("contactsheet", flag.ExitOnError)
+	ffprobe := fs.String("ffprobe", "ffprobe", "ffprobe")
+	ffmpeg := fs.String("ffmpeg", "ffmpeg", "ffmpeg")
+	out := fs.String("o", "", "输出文件, 默认是当前目录下的 视频名_sheet.jpg")
+	cols := fs.Int("cols", 4, "列数")
+	rows := fs.Int("rows", 5, "行数")
+	width := fs.Int("width", 1600, "图片宽度")
+	fontFile := fs.String("font", "", "字体文件, 为空使用内置字体")
+	imageFormat := fs.String("image-format", FormatJpeg, "图片格式, jpeg, png, webp")
+	imageQuality := fs.Int("image-quality", 80, "图片质量, 1~100")
+	resizeFilter := fs.String("resize-filter", "lanczos3", "缩放算法")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s contactsheet [参数] 视频文件\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	path := fs.Arg(0)
+	cfg := ContactSheetConfig{
+		Cols:     *cols,
+		Rows:     *rows,
+		Width:    *width,
+		Output:   imageOutput(*ffmpeg, *imageFormat, *imageQuality, *resizeFilter, "#000000"),
+		FontFile: *fontFile,
+	}
+	if *out == "" {
+		*out = FileName(path) + "_sheet" + cfg.Output.Ext()
+	}
+
+	v, err := VideoInfo(*ffprobe, path)
+	if err != nil {
+		log.Fatalf("获取视频信息失败: %+v", err)
+	}
+	err = GenContactSheet(context.Background(), *ffmpeg, v, *out, cfg)
+	if err != nil {
+		log.Fatalf("联系表生成失败: %+v", err)
+	}
+	fmt.Println(*out)
+}
+
+// 解析图片输出参数, 参数错误直接退出
+func imageOutput(ffmpeg, format string, quality int, resizeFilter, letterbox string) ImageOutput {
+	output := ImageOutput{Format: format, Quality: quality, FFmpeg: ffmpeg}
+	filter, err := ParseResizeFilter(resizeFilter)
+	if err != nil {
+		log.Fatalf("参数错误: %v", err)
+	}
+	output.Filter = filter
+	output.Letterbox, err = ParseHexColor(letterbox)
+	if err != nil {
+		log.Fatalf("参数错误: %v", err)
+	}
+	if output.Format == FormatWebp && !HasEncoder(ffmpeg, "libwebp") {
+		log.Printf("ffmpeg 不支持 webp, 使用 jpeg")
+		output.Format = FormatJpeg
+	}
+	return output
+}
+
+// 可以指定多次的参数
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// 逗号分隔的列表
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
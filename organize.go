@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 自定义合集, 视频按手动调整的顺序排列
+type Collection struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// 创建的用户, 只有创建者和管理员可以修改
+	Owner   string    `json:"owner"`
+	Videos  []string  `json:"videos"`
+	Created time.Time `json:"created"`
+}
+
+// 标签和使用的次数
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// 收藏, 标签和合集, 和视频信息缓存放在一起
+// 收藏是每个用户自己的, 标签和合集所有用户共享, 只有添加的用户和管理员可以修改
+type organizeStore struct {
+	mu   sync.RWMutex
+	path string
+
+	// 用户 -> 视频id -> 收藏时间
+	Favorites map[string]map[string]time.Time `json:"favorites"`
+	// 视频id -> 标签
+	Tags map[string][]string `json:"tags"`
+	// 视频id -> 添加标签的用户
+	TagOwners   map[string]string      `json:"tagOwners"`
+	Collections map[string]*Collection `json:"collections"`
+}
+
+var organize = newOrganizeStore("")
+
+func newOrganizeStore(path string) *organizeStore {
+	return &organizeStore{
+		path:        path,
+		Favorites:   map[string]map[string]time.Time{},
+		Tags:        map[string][]string{},
+		TagOwners:   map[string]string{},
+		Collections: map[string]*Collection{},
+	}
+}
+
+// 读取收藏, 标签和合集, 文件不存在时为空
+func LoadOrganize(path string) error {
+	s := newOrganizeStore(path)
+	if IsFileExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取收藏信息失败")
+		}
+		if err = json.Unmarshal(data, s); err != nil {
+			return errors.WithMessage(err, "解析收藏信息失败")
+		}
+	}
+	organize = s
+	return nil
+}
+
+// 保存, 调用时需要持有锁
+func (s *organizeStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveJSON(s.path, s, "收藏信息")
+}
+
+// 收藏或取消收藏
+func (s *organizeStore) SetFavorite(user, id string, favorite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	favs := s.Favorites[user]
+	if favs == nil {
+		favs = map[string]time.Time{}
+		s.Favorites[user] = favs
+	}
+	if favorite {
+		if _, ok := favs[id]; !ok {
+			favs[id] = time.Now()
+		}
+	} else {
+		delete(favs, id)
+	}
+	return s.save()
+}
+
+// 删除用户的收藏, 用户添加的标签其他用户可以修改
+func (s *organizeStore) DeleteUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Favorites, user)
+	for id, owner := range s.TagOwners {
+		if owner == user {
+			delete(s.TagOwners, id)
+		}
+	}
+	return s.save()
+}
+
+// 整理标签, 去掉空白和重复的
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		res = append(res, tag)
+	}
+	return res
+}
+
+// 设置视频的标签, 第一个添加标签的用户之后只有这个用户和管理员可以修改
+func (s *organizeStore) SetTags(u *UserInfo, id string, tags []string) ([]string, error) {
+	tags = normalizeTags(tags)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.TagOwners[id]; ok && owner != u.Name && !u.Admin {
+		return nil, NewError(ErrForbidden, "只有添加标签的用户可以修改")
+	}
+	if len(tags) == 0 {
+		delete(s.Tags, id)
+		delete(s.TagOwners, id)
+	} else {
+		s.Tags[id] = tags
+		if _, ok := s.TagOwners[id]; !ok {
+			s.TagOwners[id] = u.Name
+		}
+	}
+	return tags, s.save()
+}
+
+// ids 中视频的标签, 使用多的在前面
+func (s *organizeStore) AllTags(ids map[string]bool) []TagCount {
+	s.mu.RLock()
+	counts := map[string]int{}
+	for id, tags := range s.Tags {
+		if !ids[id] {
+			continue
+		}
+		for _, tag := range tags {
+			counts[tag]++
+		}
+	}
+	s.mu.RUnlock()
+
+	res := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		res = append(res, TagCount{tag, n})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Tag < res[j].Tag
+	})
+	return res
+}
+
+// 所有合集, 只包含 ids 中的视频, 按创建时间排序
+func (s *organizeStore) AllCollections(ids map[string]bool) []Collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]Collection, 0, len(s.Collections))
+	for _, c := range s.Collections {
+		res = append(res, c.copy().visible(ids))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res
+}
+
+func (c *Collection) copy() Collection {
+	cc := *c
+	cc.Videos = make([]string, len(c.Videos))
+	copy(cc.Videos, c.Videos)
+	return cc
+}
+
+// 只保留 ids 中的视频, 不能访问的视频和不存在一样
+func (c Collection) visible(ids map[string]bool) Collection {
+	videos := make([]string, 0, len(c.Videos))
+	for _, id := range c.Videos {
+		if ids[id] {
+			videos = append(videos, id)
+		}
+	}
+	c.Videos = videos
+	return c
+}
+
+// 用可以访问的视频替换合集中的视频, 不能访问的视频保留在原来的位置
+// 没有解锁隐藏的库或者没有权限时修改合集, 不会丢掉看不到的视频
+func (c *Collection) replaceVisible(videos []string, ids map[string]bool) {
+	var next []string
+	for _, id := range uniqueIDs(videos) {
+		if ids[id] {
+			next = append(next, id)
+		}
+	}
+	res := make([]string, 0, len(c.Videos)+len(next))
+	for _, id := range c.Videos {
+		if !ids[id] {
+			res = append(res, id)
+			continue
+		}
+		if len(next) > 0 {
+			res = append(res, next[0])
+			next = next[1:]
+		}
+	}
+	c.Videos = append(res, next...)
+}
+
+// 视频id的集合
+func videoIDs(videos []*Video) map[string]bool {
+	ids := make(map[string]bool, len(videos))
+	for _, v := range videos {
+		ids[v.ID] = true
+	}
+	return ids
+}
+
+// 当前用户可以访问的视频id
+func accessibleIDs(r *http.Request) map[string]bool {
+	return videoIDs(accessibleVideos(r, Videos()))
+}
+
+// 获取合集, 不存在返回 false
+func (s *organizeStore) Collection(cid string) (Collection, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.Collections[cid]
+	if !ok {
+		return Collection{}, false
+	}
+	return c.copy(), true
+}
+
+// 创建合集
+func (s *organizeStore) CreateCollection(owner, name string) (Collection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Collection{}, NewError(ErrBadRequest, "合集名字不能为空")
+	}
+	c := &Collection{ID: randomToken(8), Name: name, Owner: owner, Videos: []string{}, Created: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Collections[c.ID] = c
+	return c.copy(), s.save()
+}
+
+// 修改合集, 只有创建者和管理员可以修改
+func (s *organizeStore) UpdateCollection(u *UserInfo, cid string, fn func(c *Collection) error) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Collections[cid]
+	if !ok {
+		return Collection{}, NewError(ErrNotFound, "合集不存在: %v", cid)
+	}
+	if c.Owner != u.Name && !u.Admin {
+		return Collection{}, NewError(ErrForbidden, "只有创建者可以修改合集")
+	}
+	if err := fn(c); err != nil {
+		return Collection{}, err
+	}
+	return c.copy(), s.save()
+}
+
+// 删除合集
+func (s *organizeStore) DeleteCollection(u *UserInfo, cid string) error {
+	_, err := s.UpdateCollection(u, cid, func(c *Collection) error {
+		delete(s.Collections, cid)
+		return nil
+	})
+	return err
+}
+
+// 整理合集的视频, 去掉重复的
+func uniqueIDs(ids []string) []string {
+	seen := map[string]bool{}
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// 给视频加上用户的收藏和标签
+func (s *organizeStore) Annotate(user string, videos []*UserVideo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	favs := s.Favorites[user]
+	for _, v := range videos {
+		_, v.Favorite = favs[v.ID]
+		v.Tags = s.Tags[v.ID]
+	}
+}
+
+// 按标签, 合集和收藏过滤视频, 为空的条件不过滤
+// 按合集过滤时使用合集的顺序
+func FilterVideos(videos []*UserVideo, tag string, collection *Collection, favorite bool) []*UserVideo {
+	if collection != nil {
+		byID := make(map[string]*UserVideo, len(videos))
+		for _, v := range videos {
+			byID[v.ID] = v
+		}
+		ordered := make([]*UserVideo, 0, len(collection.Videos))
+		for _, id := range collection.Videos {
+			if v, ok := byID[id]; ok {
+				ordered = append(ordered, v)
+			}
+		}
+		videos = ordered
+	}
+
+	res := make([]*UserVideo, 0, len(videos))
+	for _, v := range videos {
+		if favorite && !v.Favorite {
+			continue
+		}
+		if tag != "" && !containsString(v.Tags, tag) {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 收藏或取消收藏
+func SetFavorite(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	req := struct {
+		Favorite bool `json:"favorite"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	if err := organize.SetFavorite(CurrentUser(r).Name, v.ID, req.Favorite); err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "收藏失败"))
+		return
+	}
+	OkCode(w, req.Favorite)
+}
+
+// 获取收藏的视频
+func GetFavorites(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, FilterVideos(currentUserVideos(r), "", nil, true))
+}
+
+// 设置视频的标签, 替换原来的标签
+func SetVideoTags(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	var tags []string
+	if err := readJson(r, &tags); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	tags, err := organize.SetTags(CurrentUser(r), v.ID, tags)
+	if err != nil {
+		if CodeOf(err) == ErrInternal {
+			err = WrapError(err, ErrInternal, "设置标签失败")
+		}
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, tags)
+}
+
+// 获取可以访问的视频的所有标签
+func GetTags(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, organize.AllTags(accessibleIDs(r)))
+}
+
+// 获取所有合集, 只包含可以访问的视频
+func GetCollections(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, organize.AllCollections(accessibleIDs(r)))
+}
+
+// 获取合集和合集中可以访问的视频
+func GetCollection(w http.ResponseWriter, r *http.Request) {
+	c, ok := organize.Collection(mux.Vars(r)["cid"])
+	if !ok {
+		WriteError(w, r, NewError(ErrNotFound, "合集不存在"))
+		return
+	}
+	OkCode(w, struct {
+		Collection
+		Videos []*UserVideo `json:"videos"`
+	}{c.visible(accessibleIDs(r)), FilterVideos(currentUserVideos(r), "", &c, false)})
+}
+
+// 创建合集
+func AddCollection(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name   string   `json:"name"`
+		Videos []string `json:"videos"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	c, err := organize.CreateCollection(CurrentUser(r).Name, req.Name)
+	if err == nil && len(req.Videos) > 0 {
+		c, err = organize.UpdateCollection(CurrentUser(r), c.ID, func(c *Collection) error {
+			c.Videos = uniqueIDs(req.Videos)
+			return nil
+		})
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, c.visible(accessibleIDs(r)))
+}
+
+// 修改合集的名字和视频, 视频的顺序就是合集的顺序, 不传的字段不修改
+func SetCollection(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name   *string  `json:"name"`
+		Videos []string `json:"videos"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	ids := accessibleIDs(r)
+	c, err := organize.UpdateCollection(CurrentUser(r), mux.Vars(r)["cid"], func(c *Collection) error {
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			if name == "" {
+				return NewError(ErrBadRequest, "合集名字不能为空")
+			}
+			c.Name = name
+		}
+		if req.Videos != nil {
+			c.replaceVisible(req.Videos, ids)
+		}
+		return nil
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, c.visible(ids))
+}
+
+// 删除合集
+func RemoveCollection(w http.ResponseWriter, r *http.Request) {
+	if err := organize.DeleteCollection(CurrentUser(r), mux.Vars(r)["cid"]); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 添加视频到合集的最后
+func AddCollectionVideo(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	c, err := organize.UpdateCollection(CurrentUser(r), mux.Vars(r)["cid"], func(c *Collection) error {
+		c.Videos = uniqueIDs(append(c.Videos, v.ID))
+		return nil
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, c.visible(accessibleIDs(r)))
+}
+
+// 从合集中移除视频
+func RemoveCollectionVideo(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	c, err := organize.UpdateCollection(CurrentUser(r), mux.Vars(r)["cid"], func(c *Collection) error {
+		for i, vid := range c.Videos {
+			if vid == id {
+				c.Videos = append(c.Videos[:i], c.Videos[i+1:]...)
+				return nil
+			}
+		}
+		return NewError(ErrNotFound, "视频不在合集中")
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, c.visible(accessibleIDs(r)))
+}
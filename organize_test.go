@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOrganizeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "organize")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "organize.json")
+
+	s := newOrganizeStore(file)
+	alice := &UserInfo{Name: "alice"}
+	s.SetFavorite("alice", "b", true)
+	if tags, _ := s.SetTags(alice, "a", []string{" 动画 ", "家庭", "动画", ""}); !reflect.DeepEqual(tags, []string{"动画", "家庭"}) {
+		t.Errorf("SetTags() = %v", tags)
+	}
+	s.SetTags(alice, "c", []string{"动画"})
+	// 标签只有添加的用户和管理员可以修改
+	if _, err := s.SetTags(&UserInfo{Name: "bob"}, "c", nil); err == nil {
+		t.Errorf("SetTags() 其他用户应该返回错误")
+	}
+	if _, err := s.SetTags(&UserInfo{Name: "admin", Admin: true}, "c", []string{"动画"}); err != nil {
+		t.Errorf("SetTags() 管理员 error = %v", err)
+	}
+	c, err := s.CreateCollection("alice", "周末")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := s.UpdateCollection(&UserInfo{Name: "bob"}, c.ID, func(c *Collection) error { return nil }); err == nil {
+		t.Errorf("UpdateCollection() 其他用户应该返回错误")
+	}
+	s.UpdateCollection(alice, c.ID, func(c *Collection) error {
+		c.Videos = uniqueIDs([]string{"c", "a", "c", "d"})
+		return nil
+	})
+
+	// 重新读取
+	if err := LoadOrganize(file); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	s = organize
+	if tags := s.AllTags(map[string]bool{"a": true, "b": true, "c": true}); !reflect.DeepEqual(tags, []TagCount{{"动画", 2}, {"家庭", 1}}) {
+		t.Errorf("AllTags() = %v", tags)
+	}
+	// 不能访问的视频的标签不统计
+	if tags := s.AllTags(map[string]bool{"c": true}); !reflect.DeepEqual(tags, []TagCount{{"动画", 1}}) {
+		t.Errorf("AllTags() 部分视频 = %v", tags)
+	}
+	if cs := s.AllCollections(map[string]bool{"a": true}); len(cs) != 1 || !reflect.DeepEqual(cs[0].Videos, []string{"a"}) {
+		t.Errorf("AllCollections() 应该只包含可以访问的视频, got %v", cs)
+	}
+	c, _ = s.Collection(c.ID)
+
+	videos := []*UserVideo{{Video: &Video{ID: "a"}}, {Video: &Video{ID: "b"}}, {Video: &Video{ID: "c"}}}
+	s.Annotate("alice", videos)
+
+	ids := func(vs []*UserVideo) []string {
+		res := []string{}
+		for _, v := range vs {
+			res = append(res, v.ID)
+		}
+		return res
+	}
+	tests := []struct {
+		name       string
+		tag        string
+		collection *Collection
+		favorite   bool
+		want       []string
+	}{
+		{"不过滤", "", nil, false, []string{"a", "b", "c"}},
+		{"标签", "动画", nil, false, []string{"a", "c"}},
+		{"收藏", "", nil, true, []string{"b"}},
+		{"合集的顺序, 不能访问的视频跳过", "", &c, false, []string{"c", "a"}},
+		{"合集和标签", "家庭", &c, false, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(FilterVideos(videos, tt.tag, tt.collection, tt.favorite)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterVideos() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := s.DeleteCollection(alice, c.ID); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(s.AllCollections(nil)) != 0 {
+		t.Errorf("DeleteCollection() 没有删除")
+	}
+}
+
+func TestCollectionReplaceVisible(t *testing.T) {
+	ids := map[string]bool{"a": true, "b": true, "c": true}
+	tests := []struct {
+		name   string
+		videos []string
+		req    []string
+		want   []string
+	}{
+		{"都可以访问", []string{"a", "b"}, []string{"b", "a", "c"}, []string{"b", "a", "c"}},
+		{"看不到的视频保留在原来的位置", []string{"a", "h1", "b", "h2"}, []string{"b", "a"}, []string{"b", "h1", "a", "h2"}},
+		{"移除可以访问的视频", []string{"h1", "a", "b"}, []string{"b"}, []string{"h1", "b"}},
+		{"清空只清空可以访问的", []string{"a", "h1"}, []string{}, []string{"h1"}},
+		{"添加的视频放在最后", []string{"h1", "a"}, []string{"a", "c"}, []string{"h1", "a", "c"}},
+		{"不能添加看不到的视频", []string{"a"}, []string{"a", "x", "a"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Collection{Videos: tt.videos}
+			c.replaceVisible(tt.req, ids)
+			if !reflect.DeepEqual(c.Videos, tt.want) {
+				t.Errorf("replaceVisible() = %v, want %v", c.Videos, tt.want)
+			}
+		})
+	}
+}
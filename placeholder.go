@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// 计算占位图之前先缩小, 结果差别不大但是快很多
+const placeholderSize = 32
+
+// 封面的占位信息, 图片加载完成之前显示
+func CoverPlaceholder(img image.Image) (blurHash string, dominant string) {
+	small := resize.Thumbnail(placeholderSize, placeholderSize, img, resize.Bilinear)
+	return EncodeBlurHash(small, 4, 3), DominantColor(small)
+}
+
+// 计算图片的 BlurHash, xComp 和 yComp 为 1~9, 参考 https://github.com/woltapp/blurhash
+func EncodeBlurHash(img image.Image, xComp, yComp int) string {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	// 每个分量的系数
+	factors := make([][3]float64, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, bl float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					pr, pg, pb, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					r += basis * sRGBToLinear(pr>>8)
+					g += basis * sRGBToLinear(pg>>8)
+					bl += basis * sRGBToLinear(pb>>8)
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors[j*xComp+i] = [3]float64{r * scale, g * scale, bl * scale}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComp-1)+(yComp-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, c := range f {
+				actualMax = math.Max(actualMax, math.Abs(c))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	sb.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+func encode83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+	return sb.String()
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// 图片的主色, #rrggbb 格式
+// 每个通道量化成16级统计, 取像素最多的那一组的平均颜色
+func DominantColor(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b uint64
+	}
+	buckets := map[uint32]*bucket{}
+	var best *bucket
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			r, g, bl = r>>8, g>>8, bl>>8
+			key := (r>>4)<<8 | (g>>4)<<4 | bl>>4
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += uint64(r)
+			bk.g += uint64(g)
+			bk.b += uint64(bl)
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return "#000000"
+	}
+	n := uint64(best.count)
+	return fmt.Sprintf("#%02x%02x%02x", best.r/n, best.g/n, best.b/n)
+}
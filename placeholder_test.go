@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 32, 18))
+	draw.Draw(black, black.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	// 纯色图片没有交流分量
+	want := "L0" + "0000" + strings.Repeat("fQ", 11)
+	if got := EncodeBlurHash(black, 4, 3); got != want {
+		t.Errorf("EncodeBlurHash() = %v, want %v", got, want)
+	}
+
+	half := image.NewRGBA(image.Rect(0, 0, 32, 18))
+	draw.Draw(half, image.Rect(0, 0, 16, 18), image.NewUniform(color.White), image.Point{}, draw.Src)
+	got := EncodeBlurHash(half, 4, 3)
+	if len(got) != 28 || got == want {
+		t.Errorf("EncodeBlurHash() = %v", got)
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	fill := func(img *image.RGBA, r image.Rectangle, c color.RGBA) *image.RGBA {
+		draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+		return img
+	}
+	red := fill(image.NewRGBA(image.Rect(0, 0, 10, 10)), image.Rect(0, 0, 10, 10), color.RGBA{R: 200, A: 255})
+	fill(red, image.Rect(0, 0, 4, 4), color.RGBA{B: 255, A: 255})
+	gray := fill(image.NewRGBA(image.Rect(0, 0, 10, 10)), image.Rect(0, 0, 10, 10), color.RGBA{R: 16, G: 16, B: 16, A: 255})
+	fill(gray, image.Rect(0, 5, 10, 10), color.RGBA{R: 18, G: 18, B: 18, A: 255})
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"空图片", image.NewRGBA(image.Rect(0, 0, 0, 0)), "#000000"},
+		{"大部分是红色", red, "#c80000"},
+		{"相近的颜色取平均", gray, "#111111"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DominantColor(tt.img); got != tt.want {
+				t.Errorf("DominantColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoverWidth(t *testing.T) {
+	tests := []struct {
+		name     string
+		width    int
+		original int
+		want     int
+	}{
+		{"向上取整", 300, 1280, 320},
+		{"正好", 640, 1280, 640},
+		{"超过原图", 1280, 1280, 0},
+		{"超过最大宽度", 2000, 1280, 0},
+		{"原图较小", 480, 400, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coverWidth(tt.width, tt.original); got != tt.want {
+				t.Errorf("coverWidth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
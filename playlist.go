@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 播放链接签名的默认有效期和最长有效期
+const (
+	defaultStreamTokenTTL = 24 * time.Hour
+	maxStreamTokenTTL     = 30 * 24 * time.Hour
+)
+
+// 播放链接签名内容的前缀, 和分享的 token 区分开
+const streamTokenPrefix = "stream:"
+
+// 播放链接签名的内容
+type streamClaims struct {
+	User    string `json:"u"`
+	Video   string `json:"v"`
+	Expires int64  `json:"e"`
+	// 导出时会话已经解锁隐藏的库
+	Unlocked bool `json:"h,omitempty"`
+}
+
+// 生成播放链接的签名 token, 只能播放这一个视频
+func streamToken(user, id string, unlocked bool, expires time.Time) string {
+	data, _ := json.Marshal(streamClaims{User: user, Video: id, Expires: expires.Unix(), Unlocked: unlocked})
+	return Sign(streamTokenPrefix + string(data))
+}
+
+// 验证播放链接的 token, 返回签名的内容
+func verifyStreamToken(token, id string, now time.Time) (streamClaims, bool) {
+	var c streamClaims
+	payload, ok := Verify(token)
+	if !ok || !strings.HasPrefix(payload, streamTokenPrefix) {
+		return c, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(payload, streamTokenPrefix)), &c); err != nil {
+		return c, false
+	}
+	if c.Video != id || now.Unix() > c.Expires {
+		return c, false
+	}
+	return c, true
+}
+
+// 带签名 token 的播放请求的用户和解锁状态, 只对视频文件本身有效
+// 每次都重新检查用户的权限, 签名后访问规则修改或者用户删除的, token 也失效
+func streamTokenUser(r *http.Request) (UserInfo, bool, bool) {
+	q := r.URL.Query()
+	token := q.Get("token")
+	if r.URL.Path != "/content" || token == "" {
+		return UserInfo{}, false, false
+	}
+	p := filepath.Clean(q.Get("path"))
+	v := contentVideo(p)
+	if v == nil || v.Path != p {
+		return UserInfo{}, false, false
+	}
+	c, ok := verifyStreamToken(token, v.ID, time.Now())
+	if !ok {
+		return UserInfo{}, false, false
+	}
+	u, ok := users.Get(c.User)
+	if !ok || !users.CanAccess(&u, c.Unlocked, conf.Libraries, v.Path) {
+		return UserInfo{}, false, false
+	}
+	return u, c.Unlocked, true
+}
+
+// 请求的服务地址, 如 http://192.168.1.2:8080
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// 视频的播放地址, expires 不为零时带上签名的 token
+func streamURL(r *http.Request, v *Video, expires time.Time) string {
+	q := url.Values{"path": {v.Path}}
+	if !expires.IsZero() {
+		q.Set("token", streamToken(CurrentUser(r).Name, v.ID, isUnlocked(r), expires))
+	}
+	return baseURL(r) + "/content?" + q.Encode()
+}
+
+// 播放列表中的名字不能换行
+func playlistTitle(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// 播放地址签名的过期时间, 请求的 sign 为 true 时签名, expires 为有效期
+func playlistExpires(r *http.Request) (time.Time, error) {
+	q := r.URL.Query()
+	if q.Get("sign") != "true" {
+		return time.Time{}, nil
+	}
+	ttl := defaultStreamTokenTTL
+	if s := q.Get("expires"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxStreamTokenTTL {
+			return time.Time{}, NewError(ErrBadRequest, "有效期错误: %v", s)
+		}
+		ttl = d
+	}
+	return time.Now().Add(ttl), nil
+}
+
+func sortByPath(videos []*UserVideo) {
+	sort.SliceStable(videos, func(i, j int) bool {
+		return videos[i].Path < videos[j].Path
+	})
+}
+
+// 写入 M3U8 格式的播放列表
+func writeM3U8(w http.ResponseWriter, r *http.Request, name string, videos []*UserVideo, expires time.Time) {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", playlistTitle(name))
+	for _, v := range videos {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n", int(v.Duration.Seconds()), playlistTitle(v.Name))
+		b.WriteString(streamURL(r, v.Video, expires))
+		b.WriteString("\n")
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// XSPF 格式的播放列表
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	// 毫秒
+	Duration int64 `xml:"duration"`
+}
+
+// 写入 XSPF 格式的播放列表
+func writeXSPF(w http.ResponseWriter, r *http.Request, name string, videos []*UserVideo, expires time.Time) {
+	p := xspfPlaylist{Version: 1, Title: name, Tracks: make([]xspfTrack, len(videos))}
+	for i, v := range videos {
+		p.Tracks[i] = xspfTrack{Location: streamURL(r, v.Video, expires), Title: v.Name, Duration: v.Duration.Milliseconds()}
+	}
+	data, err := xml.MarshalIndent(p, "", "  ")
+	if err != nil {
+		WriteError(w, r, WrapError(err, ErrInternal, "生成播放列表失败"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/xspf+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// 写入播放列表, format 为 m3u8 或 xspf
+func WritePlaylist(w http.ResponseWriter, r *http.Request, format, name string, videos []*UserVideo) {
+	expires, err := playlistExpires(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s.%s", url.PathEscape(name), format))
+	if format == "xspf" {
+		writeXSPF(w, r, name, videos, expires)
+		return
+	}
+	writeM3U8(w, r, name, videos, expires)
+}
+
+// 导出播放列表, 格式为 m3u8 或 xspf
+// folder 导出目录, collection 导出合集, q 导出搜索结果, 可以和 tag, favorite 一起使用
+// sign 为 true 时播放地址带上签名的 token, 外部播放器不用登录, expires 为有效期, 默认24小时
+func ExportPlaylist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := "night"
+	var collection *Collection
+	if cid := q.Get("collection"); cid != "" {
+		c, ok := organize.Collection(cid)
+		if !ok {
+			WriteError(w, r, NewError(ErrNotFound, "合集不存在"))
+			return
+		}
+		collection = &c
+		name = c.Name
+	}
+	videos := FilterVideos(currentUserVideos(r), q.Get("tag"), collection, q.Get("favorite") == "true")
+
+	if folder := q.Get("folder"); folder != "" {
+		folder = filepath.Clean(folder)
+		var res []*UserVideo
+		for _, v := range videos {
+			if isWithin(folder, v.Path) {
+				res = append(res, v)
+			}
+		}
+		// 目录按路径排序, 和文件管理器里看到的一样
+		sortByPath(res)
+		videos = res
+		name = filepath.Base(folder)
+	}
+
+	videos, ok := searchVideos(w, r, videos)
+	if !ok {
+		return
+	}
+	if q.Get("q") != "" && collection == nil && q.Get("folder") == "" {
+		name = "搜索结果"
+	}
+	WritePlaylist(w, r, mux.Vars(r)["format"], name, videos)
+}
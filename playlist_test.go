@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	old := signKey
+	defer func() { signKey = old }()
+	signKey = []byte(strings.Repeat("k", 32))
+
+	token := Sign("hello")
+	if payload, ok := Verify(token); !ok || payload != "hello" {
+		t.Errorf("Verify() = %v, %v", payload, ok)
+	}
+	// 用 hello 的签名冒充 hello2
+	tampered := Sign("hello2")[:strings.LastIndex(Sign("hello2"), ".")] + token[strings.LastIndex(token, "."):]
+	if _, ok := Verify(tampered); ok {
+		t.Errorf("Verify() 修改过的内容应该失败")
+	}
+	if _, ok := Verify("invalid"); ok {
+		t.Errorf("Verify() 格式错误应该失败")
+	}
+
+	now := time.Now()
+	st := streamToken("alice", "v1", false, now.Add(time.Hour))
+	tests := []struct {
+		name string
+		id   string
+		now  time.Time
+		want bool
+	}{
+		{"有效", "v1", now, true},
+		{"其他视频", "v2", now, false},
+		{"过期", "v1", now.Add(2 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, ok := verifyStreamToken(st, tt.id, tt.now); ok != tt.want || (ok && c.User != "alice") {
+				t.Errorf("verifyStreamToken() = %v, %v, want %v", c, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestWritePlaylist(t *testing.T) {
+	old := signKey
+	defer func() { signKey = old }()
+	signKey = []byte(strings.Repeat("k", 32))
+
+	videos := []*UserVideo{
+		{Video: &Video{ID: "a", Name: "第一集", Path: "/media/tv/01.mkv", Duration: 90 * time.Second}},
+		{Video: &Video{ID: "b", Name: "第二\n集", Path: "/media/tv/02 final.mkv", Duration: 2500 * time.Millisecond}},
+	}
+	newRequest := func(format, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(GET, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), userKey, &UserInfo{Name: "alice"}))
+		w := httptest.NewRecorder()
+		WritePlaylist(w, r, format, "电视剧", videos)
+		return w
+	}
+
+	w := newRequest("m3u8", "http://night.local:8080/export.m3u8")
+	want := "#EXTM3U\n#PLAYLIST:电视剧\n" +
+		"#EXTINF:90,第一集\nhttp://night.local:8080/content?path=%2Fmedia%2Ftv%2F01.mkv\n" +
+		"#EXTINF:2,第二 集\nhttp://night.local:8080/content?path=%2Fmedia%2Ftv%2F02+final.mkv\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("m3u8 = %q, want %q", got, want)
+	}
+
+	w = newRequest("xspf", "http://night.local:8080/export.xspf?sign=true&expires=1h")
+	var p xspfPlaylist
+	if err := xml.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if p.Title != "电视剧" || len(p.Tracks) != 2 || p.Tracks[0].Duration != 90000 || p.Tracks[1].Title != "第二\n集" {
+		t.Errorf("xspf = %+v", p)
+	}
+	u, err := url.Parse(p.Tracks[0].Location)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if c, ok := verifyStreamToken(u.Query().Get("token"), "a", time.Now()); !ok || c.User != "alice" {
+		t.Errorf("签名的链接无效: %v", p.Tracks[0].Location)
+	}
+
+	w = newRequest("m3u8", "http://night.local:8080/export.m3u8?sign=true&expires=9999h")
+	if strings.HasPrefix(w.Body.String(), "#EXTM3U") {
+		t.Errorf("有效期太长应该返回错误")
+	}
+}
+
+func TestStreamTokenUser(t *testing.T) {
+	oldKey, oldUsers, oldConf, oldStore := signKey, users, conf, Videos()
+	defer func() {
+		signKey, users, conf = oldKey, oldUsers, oldConf
+		SaveVideos(oldStore)
+	}()
+	signKey = []byte(strings.Repeat("k", 32))
+	users = newUserStore("")
+	users.Create("alice", "password1", false)
+	conf.Libraries = []*Library{{Dir: "/media/movies"}, {Dir: "/media/secret", Hidden: true}}
+	movie := &Video{ID: "m", Path: "/media/movies/a.mkv"}
+	secret := &Video{ID: "s", Path: "/media/secret/b.mkv"}
+	SaveVideos([]*Video{movie, secret})
+
+	expires := time.Now().Add(time.Hour)
+	request := func(v *Video, token string) *http.Request {
+		q := url.Values{"path": {v.Path}, "token": {token}}
+		return httptest.NewRequest(GET, "/content?"+q.Encode(), nil)
+	}
+	tests := []struct {
+		name         string
+		video        *Video
+		token        string
+		want         bool
+		wantUnlocked bool
+	}{
+		{"有效", movie, streamToken("alice", "m", false, expires), true, false},
+		{"隐藏的库已经解锁", secret, streamToken("alice", "s", true, expires), true, true},
+		{"隐藏的库没有解锁", secret, streamToken("alice", "s", false, expires), false, false},
+		{"用户不存在", movie, streamToken("bob", "m", false, expires), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, unlocked, ok := streamTokenUser(request(tt.video, tt.token))
+			if ok != tt.want || unlocked != tt.wantUnlocked || (ok && u.Name != "alice") {
+				t.Errorf("streamTokenUser() = %v, %v, %v, want %v, %v", u.Name, unlocked, ok, tt.want, tt.wantUnlocked)
+			}
+		})
+	}
+
+	// 签名后访问规则修改, 没有权限了 token 也失效
+	if err := users.SetAccessRules([]*AccessRule{{Path: "/media/movies", Users: []string{"carol"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := streamTokenUser(request(movie, streamToken("alice", "m", false, expires))); ok {
+		t.Errorf("streamTokenUser() 没有权限后应该失败")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// 预览生成队列, 客户端请求过的视频优先生成, 其他的按加入的顺序生成
+type PreviewQueue struct {
+	mu    sync.Mutex
+	items previewItems
+	// 路径 -> 队列中的任务
+	index map[string]*previewItem
+	// 正在生成的视频
+	current string
+	seq     int
+	boost   int
+}
+
+type previewItem struct {
+	path string
+	// 优先级, 越大越先生成, 每次提前都比之前的大
+	priority int
+	seq      int
+	i        int
+}
+
+type previewItems []*previewItem
+
+func (p previewItems) Len() int { return len(p) }
+
+func (p previewItems) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	return p[i].seq < p[j].seq
+}
+
+func (p previewItems) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+	p[i].i = i
+	p[j].i = j
+}
+
+func (p *previewItems) Push(x interface{}) {
+	item := x.(*previewItem)
+	item.i = len(*p)
+	*p = append(*p, item)
+}
+
+func (p *previewItems) Pop() interface{} {
+	old := *p
+	item := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return item
+}
+
+func NewPreviewQueue() *PreviewQueue {
+	return &PreviewQueue{index: map[string]*previewItem{}}
+}
+
+var previewQueue = NewPreviewQueue()
+
+// 加入队列, 已经在队列中的忽略
+func (q *PreviewQueue) Push(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.index[path]; ok || path == q.current {
+		return
+	}
+	q.seq++
+	item := &previewItem{path: path, seq: q.seq}
+	q.index[path] = item
+	heap.Push(&q.items, item)
+}
+
+// 取出下一个要生成的视频, 队列为空返回 false
+func (q *PreviewQueue) Pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.items.Len() == 0 {
+		q.current = ""
+		return "", false
+	}
+	item := heap.Pop(&q.items).(*previewItem)
+	delete(q.index, item.path)
+	q.current = item.path
+	return item.path, true
+}
+
+// 生成完成
+func (q *PreviewQueue) Done(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == path {
+		q.current = ""
+	}
+}
+
+// 提前到队列的最前面, 返回视频是否在等待或正在生成
+func (q *PreviewQueue) Prioritize(path string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if path == q.current {
+		return true
+	}
+	item, ok := q.index[path]
+	if !ok {
+		return false
+	}
+	q.boost++
+	item.priority = q.boost
+	heap.Fix(&q.items, item.i)
+	return true
+}
+
+// 等待生成的数量
+func (q *PreviewQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.items.Len()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreviewQueue(t *testing.T) {
+	q := NewPreviewQueue()
+	for _, p := range []string{"a", "b", "c", "d", "a"} {
+		q.Push(p)
+	}
+	if q.Len() != 4 {
+		t.Fatalf("Len() = %v, want 4", q.Len())
+	}
+
+	if !q.Prioritize("c") || !q.Prioritize("d") {
+		t.Errorf("Prioritize() = false, want true")
+	}
+	if q.Prioritize("e") {
+		t.Errorf("Prioritize() 不在队列中的视频 = true, want false")
+	}
+
+	// 后请求的优先
+	p, _ := q.Pop()
+	if p != "d" {
+		t.Errorf("Pop() = %v, want d", p)
+	}
+	// 正在生成的视频也算等待中, 不会重复加入
+	if !q.Prioritize("d") {
+		t.Errorf("Prioritize() 正在生成的视频 = false, want true")
+	}
+	q.Push("d")
+	q.Done("d")
+
+	var got []string
+	for {
+		p, ok := q.Pop()
+		if !ok {
+			break
+		}
+		got = append(got, p)
+		q.Done(p)
+	}
+	if want := []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pop() = %v, want %v", got, want)
+	}
+}
@@ -1,18 +1,56 @@
 package main
 
-var store []*Video
+import "sync"
+
+var (
+	store   []*Video
+	storeMu sync.RWMutex
+)
 
 // 获取所有的视频信息
 func Videos() []*Video {
-	return store
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	vs := make([]*Video, len(store))
+	copy(vs, store)
+	return vs
 }
 
 // 保存视频信息
 func SaveVideos(videos []*Video) {
+	storeMu.Lock()
 	store = videos
+	storeMu.Unlock()
 }
 
 // 添加视频
 func AddVideo(video *Video) {
+	storeMu.Lock()
+	store = append(store, video)
+	storeMu.Unlock()
+}
+
+// 添加或替换视频
+func SetVideo(video *Video) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	for i, v := range store {
+		if v.ID == video.ID {
+			store[i] = video
+			return
+		}
+	}
 	store = append(store, video)
 }
+
+// 根据id获取视频, 不存在返回nil
+func VideoByID(id string) *Video {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	for _, v := range store {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
@@ -8,31 +8,60 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
+// 视频信息缓存, 扫描和 http 请求都会访问, 所有访问都要加锁
 type cacheInfo struct {
-	Mod    map[string]time.Time `json:"mod"`
-	Videos map[string]*Video    `json:"videos"`
+	mu sync.RWMutex
+	// 同时只写一次文件, 扫描和设置封面都会写
+	writeMu sync.Mutex
+	Mod     map[string]time.Time `json:"mod"`
+	Videos  map[string]*Video    `json:"videos"`
+	// 发现视频文件不存在的时间
+	Missing map[string]time.Time `json:"missing"`
 }
 
 func (c *cacheInfo) ModTime(path string) time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.Mod[path]
 }
 
 func (c *cacheInfo) AddModTime(path string, time time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Mod[path] = time
 }
 
+// 缓存的视频信息, 不存在返回 nil
+func (c *cacheInfo) Video(path string) *Video {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Videos[path]
+}
+
 func (c *cacheInfo) AddVideo(video *Video) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Videos[video.Path] = video
 }
 
 func (c *cacheInfo) RemoveVideo(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeVideo(path)
+}
+
+func (c *cacheInfo) removeVideo(path string) {
 	delete(c.Videos, path)
+	delete(c.Missing, path)
 }
 
 func (c *cacheInfo) AllVideos() []*Video {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	vs := make([]*Video, len(c.Videos))
 	i := 0
 	for _, v := range c.Videos {
@@ -42,17 +71,53 @@ func (c *cacheInfo) AllVideos() []*Video {
 	return vs
 }
 
-func (c *cacheInfo) RemoveNotExistVideos() {
-	for k, _ := range c.Videos {
-		if !IsFileExists(k) {
-			delete(c.Videos, k)
+// 移除不存在的视频信息
+// 所在库离线时保留视频并标记为不可用, 库在线但文件不存在的超过宽限期才移除
+func (c *cacheInfo) RemoveNotExistVideos(libs []*Library, online map[string]bool, grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Missing == nil {
+		c.Missing = map[string]time.Time{}
+	}
+	now := time.Now()
+	// 视频信息可能正在被读取, 状态变化时替换成新的视频信息
+	setUnavailable := func(k string, v *Video, unavailable bool) {
+		if v.Unavailable == unavailable {
+			return
+		}
+		nv := v.Clone()
+		nv.Unavailable = unavailable
+		c.Videos[k] = nv
+	}
+	for k, v := range c.Videos {
+		lib := FindLibrary(libs, k)
+		if lib != nil && !online[lib.Dir] {
+			setUnavailable(k, v, true)
+			continue
+		}
+		if IsFileExists(k) {
+			setUnavailable(k, v, false)
+			delete(c.Missing, k)
+			continue
+		}
+
+		since, ok := c.Missing[k]
+		if !ok {
+			since = now
+			c.Missing[k] = since
+		}
+		// 不属于任何库的视频直接移除
+		if lib == nil || now.Sub(since) >= grace {
+			c.removeVideo(k)
 			delete(c.Mod, k)
+			continue
 		}
+		setUnavailable(k, v, true)
 	}
 }
 
 func (c *cacheInfo) IsExists(path string) bool {
-	v := c.Videos[path]
+	v := c.Video(path)
 	if v == nil {
 		return false
 	}
@@ -65,8 +130,8 @@ func (c *cacheInfo) IsExists(path string) bool {
 	return IsFileExists(v.Preview.Cover) && IsFileExists(v.Preview.Thumbs.Path)
 }
 
-func (c *cacheInfo) IsEmpty() bool {
-	return len(c.Mod) <= 0 && len(c.Videos) <= 0
+func (c *cacheInfo) isEmpty() bool {
+	return len(c.Mod) <= 0 && len(c.Videos) <= 0 && len(c.Missing) <= 0
 }
 
 func (c *cacheInfo) Read(path string) error {
@@ -74,18 +139,34 @@ func (c *cacheInfo) Read(path string) error {
 	if err != nil {
 		return errors.WithMessage(err, "读取缓存信息失败")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	err = json.Unmarshal(data, c)
 	if err != nil {
 		return errors.WithMessage(err, "解析缓存信息失败")
 	}
+	// 旧的缓存没有id和添加时间, 添加时间使用文件的修改时间
+	for _, v := range c.Videos {
+		if v.ID == "" {
+			v.ID = VideoID(v.Path)
+		}
+		if v.Added.IsZero() {
+			v.Added = c.Mod[v.Path]
+		}
+	}
 	return nil
 }
 
 func (c *cacheInfo) Write(path string) error {
-	if c.IsEmpty() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.RLock()
+	if c.isEmpty() {
+		c.mu.RUnlock()
 		return nil
 	}
 	data, err := json.Marshal(c)
+	c.mu.RUnlock()
 	if err != nil {
 		return errors.WithMessage(err, "生成缓存信息失败")
 	}
@@ -93,7 +174,7 @@ func (c *cacheInfo) Write(path string) error {
 	if err != nil {
 		return errors.WithMessage(err, "创建缓存信息失败")
 	}
-	err = ioutil.WriteFile(path, data, os.ModePerm)
+	err = WriteFileAtomic(path, data, os.ModePerm)
 	if err != nil {
 		return errors.WithMessage(err, "写入缓存信息失败")
 	}
@@ -101,7 +182,7 @@ func (c *cacheInfo) Write(path string) error {
 }
 
 var (
-	cache  = &cacheInfo{Mod: map[string]time.Time{}, Videos: map[string]*Video{}}
+	cache  = &cacheInfo{Mod: map[string]time.Time{}, Videos: map[string]*Video{}, Missing: map[string]time.Time{}}
 	ctx    context.Context
 	cancel context.CancelFunc
 	done   chan struct{}
@@ -122,22 +203,123 @@ func StopScanVideos() {
 	<-done
 }
 
+// 扫描配置
+type ScanConfig struct {
+	// 视频检测器
+	Detector *VideoDetector
+	// 库在线时, 视频文件不存在多久后移除视频信息
+	PurgeGrace time.Duration
+	// 多久检查一次库是否在线, 重新在线的库会重新扫描, 0 只在启动时检查
+	CheckInterval time.Duration
+	// 是否跟随符号链接
+	FollowSymlinks bool
+	// 最多进入几层子目录, 0 不限制
+	MaxDepth int
+	// 缩略图的采样方式
+	PreviewMode string
+	// 场景变化的阈值
+	SceneThreshold float64
+	// 通过管道读取帧生成预览, 不写临时缩略图
+	PipeFrames bool
+	// 封面和精灵图的输出配置
+	ImageOutput ImageOutput
+	// 封面来源的顺序, 为空只使用视频中的帧
+	CoverOrder []string
+}
+
 // 扫描目录生成资源
 func ScanVideos(videoDirs []string, cacheDir string, ffprobe, ffmpeg string) {
-	cacheF := filepath.Join(cacheDir, "cache.json")
+	libs := make([]*Library, len(videoDirs))
+	for i, dir := range videoDirs {
+		libs[i] = &Library{Dir: dir}
+	}
+	ScanLibraries(libs, cacheDir, ffprobe, ffmpeg, ScanConfig{})
+}
+
+// 扫描视频库生成资源
+// 设置了检查间隔时会一直运行, 定期检查库是否在线, 移除不存在的视频, 重新扫描重新在线的库
+func ScanLibraries(libs []*Library, cacheDir string, ffprobe, ffmpeg string, sc ScanConfig) {
+	defer complete()
+
+	cacheF := cacheFile(cacheDir)
 	if IsFileExists(cacheF) {
 		err := cache.Read(cacheF)
 		if err != nil {
 			fmt.Printf("缓存信息读取失败了: %+v\n", err)
-		} else {
-			// 移除不存在的视频信息
-			cache.RemoveNotExistVideos()
 		}
 	}
 
+	online := CheckLibraries(libs)
+	// 移除不存在的视频信息
+	cache.RemoveNotExistVideos(libs, online, sc.PurgeGrace)
+
+	// 有新的视频放到预览队列时通知, 关闭表示不会再有新的视频
+	wake := make(chan struct{}, 1)
+	worker := make(chan struct{})
+	go func() {
+		defer close(worker)
+		genPreviewWork(ctx, wake, cacheDir, cacheF, ffprobe, ffmpeg, sc)
+	}()
+	defer func() {
+		close(wake)
+		<-worker
+	}()
+
+	scanLibraries(libs, online, cacheF, ffprobe, ffmpeg, sc)
+	notifyPreview(wake)
+	if sc.CheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(sc.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		status := CheckLibraries(libs)
+		cache.RemoveNotExistVideos(libs, status, sc.PurgeGrace)
+		SaveVideos(cache.AllVideos())
+		writeCache(cacheF)
+
+		var back []*Library
+		for _, lib := range libs {
+			if status[lib.Dir] && !online[lib.Dir] {
+				fmt.Printf("库重新在线: %v, 重新扫描\n", lib.Dir)
+				back = append(back, lib)
+			}
+		}
+		online = status
+		if len(back) > 0 {
+			scanLibraries(back, online, cacheF, ffprobe, ffmpeg, sc)
+			notifyPreview(wake)
+		}
+	}
+}
+
+// 扫描在线的库, 读取新的和修改了的视频的信息, 放到预览队列中
+func scanLibraries(libs []*Library, online map[string]bool, cacheF string, ffprobe, ffmpeg string, sc ScanConfig) {
+	detector := sc.Detector
+	if detector == nil {
+		detector = defaultDetector
+	}
+
 	var videos []string
-	for _, resDir := range videoDirs {
-		filepath.Walk(resDir, func(path string, info os.FileInfo, err error) error {
+	// 只需要重新生成字幕的视频
+	var subtitleVideos []string
+	// 重新生成信息的视频原来的添加时间
+	added := map[string]time.Time{}
+	w := newWalker(sc.FollowSymlinks, sc.MaxDepth)
+	for _, lib := range libs {
+		if !online[lib.Dir] {
+			fmt.Printf("库离线: %v, 跳过\n", lib.Dir)
+			continue
+		}
+		filter := newLibraryFilter(lib)
+		w.Walk(lib.Dir, func(path string, info os.FileInfo, err error) error {
 			// 如果取消就停止
 			if Canceled(ctx) {
 				return filepath.SkipDir
@@ -150,7 +332,18 @@ func ScanVideos(videoDirs []string, cacheDir string, ffprobe, ffmpeg string) {
 				return nil
 			}
 
+			if filter.Excluded(path, info.IsDir()) {
+				fmt.Println("已排除, 跳过")
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
 			if info.IsDir() {
+				if err := filter.EnterDir(path); err != nil {
+					fmt.Printf("读取忽略文件失败: %+v. ", err)
+				}
 				if info.ModTime() == cache.ModTime(path) {
 					fmt.Println("无需更新, 跳过")
 					return filepath.SkipDir
@@ -161,7 +354,12 @@ func ScanVideos(videoDirs []string, cacheDir string, ffprobe, ffmpeg string) {
 				return nil
 			}
 
-			if !IsVideo(path) {
+			if !filter.Included(path) {
+				fmt.Println("未包含, 跳过")
+				return nil
+			}
+
+			if !detector.IsVideo(path) {
 				fmt.Println("不是视频，跳过")
 				return nil
 			}
@@ -174,11 +372,22 @@ func ScanVideos(videoDirs []string, cacheDir string, ffprobe, ffmpeg string) {
 			}
 
 			if info.ModTime() == cache.ModTime(path) {
+				// 添加或修改字幕文件不会改变视频的修改时间
+				if changed, err := ExternalSubtitlesChanged(cache.Video(path)); err != nil {
+					fmt.Printf("检查字幕失败: %+v. ", err)
+				} else if changed {
+					fmt.Println("字幕变化, 待生成字幕")
+					subtitleVideos = append(subtitleVideos, path)
+					return nil
+				}
 				fmt.Println("无需更新, 跳过")
 				return nil
 			}
 
-			// 要生成信息, 把旧的信息移除
+			// 要生成信息, 把旧的信息移除, 保留添加时间
+			if v := cache.Video(path); v != nil {
+				added[path] = v.Added
+			}
 			cache.RemoveVideo(path)
 			videos = append(videos, path)
 
@@ -192,26 +401,68 @@ func ScanVideos(videoDirs []string, cacheDir string, ffprobe, ffmpeg string) {
 	writeCache(cacheF)
 
 	if Canceled(ctx) {
-		complete()
 		return
 	}
 
-	// 提交生成视频信息的任务
-	if len(videos) <= 0 {
-		complete()
-		return
+	// 先读取视频的基本信息, 马上就可以在目录中看到, 预览放到队列中按优先级生成
+	for _, p := range videos {
+		if Canceled(ctx) {
+			writeCache(cacheF)
+			return
+		}
+		v, err := VideoInfo(ffprobe, p)
+		if err != nil {
+			fmt.Printf("视频信息读取失败: %+v\n", err)
+			continue
+		}
+		v.Added = time.Now()
+		if old := cache.Video(p); old != nil && !old.Added.IsZero() {
+			v.Added = old.Added
+		} else if t := added[p]; !t.IsZero() {
+			v.Added = t
+		}
+		addCacheVideo(v)
+		previewQueue.Push(p)
 	}
 
-	videosIn := make(chan string)
-	go genVideoInfoWork(ctx, videosIn, len(videos), cacheDir, cacheF, ffprobe, ffmpeg)
-	for _, v := range videos {
-		select {
-		case <-ctx.Done():
-			close(videosIn)
-			return
-		case videosIn <- v:
+	for _, p := range subtitleVideos {
+		if Canceled(ctx) {
+			break
 		}
+		updateSubtitles(ctx, ffprobe, ffmpeg, p)
 	}
+	writeCache(cacheF)
+}
+
+// 通知预览生成有新的视频, 已经有通知时不用再通知
+func notifyPreview(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// 重新生成视频的字幕, 放在原来的预览目录中, 其他预览不变
+func updateSubtitles(ctx context.Context, ffprobe, ffmpeg, path string) {
+	old := cache.Video(path)
+	if old == nil || old.Preview == nil {
+		return
+	}
+	v := old.Clone()
+	dir := filepath.Join(filepath.Dir(v.Preview.Cover), "subtitles")
+	os.RemoveAll(dir)
+	subs, err := GenSubtitles(ctx, ffprobe, ffmpeg, path, dir)
+	if err != nil {
+		fmt.Printf("字幕生成失败: %+v\n", err)
+		return
+	}
+	v.Subtitles = subs
+	addCacheVideo(v)
+}
+
+// 缓存目录中的视频信息缓存文件
+func cacheFile(cacheDir string) string {
+	return filepath.Join(cacheDir, "cache.json")
 }
 
 func writeCache(cacheF string) {
@@ -223,48 +474,66 @@ func writeCache(cacheF string) {
 
 func addCacheVideo(video *Video) {
 	cache.AddVideo(video)
-	AddVideo(video)
+	SetVideo(video)
 }
 
-func genVideoInfoWork(ctx context.Context, videoIn <-chan string, count int, cacheDir, cacheF string, ffprobe, ffmpeg string) {
+// 按队列生成视频预览, 队列为空时等待通知, 通知关闭或者取消时结束
+func genPreviewWork(ctx context.Context, wake <-chan struct{}, cacheDir, cacheF string, ffprobe, ffmpeg string, sc ScanConfig) {
+	defer writeCache(cacheF)
+
+	// 有视频要生成时才启动进度服务器
+	var ps *ProgressServer
 	defer func() {
-		writeCache(cacheF)
-		complete()
+		if ps != nil {
+			ps.Stop()
+		}
 	}()
 
-	ps := &ProgressServer{}
-	err := ps.Start()
-	if err != nil {
-		fmt.Printf("启动进度服务器错误: %+v\n", err)
-		return
-	}
-	defer ps.Stop()
-
 	i := 1
-	for {
-		select {
-		case v, ok := <-videoIn:
-			if !ok {
+	for !Canceled(ctx) {
+		p, ok := previewQueue.Pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
 				return
+			case _, ok := <-wake:
+				if !ok && previewQueue.Len() <= 0 {
+					return
+				}
 			}
-			video, err := genVideoInfo(ctx, ffprobe, ffmpeg, v, cacheDir, count, i, ps)
-			i++
-			if err != nil {
-				fmt.Printf("视频信息生成失败: %+v\n", err)
-				continue
+			continue
+		}
+		v := cache.Video(p)
+		if v == nil {
+			previewQueue.Done(p)
+			continue
+		}
+		if ps == nil {
+			ps = &ProgressServer{}
+			if err := ps.Start(); err != nil {
+				fmt.Printf("启动进度服务器错误: %+v\n", err)
+				ps = nil
+				previewQueue.Done(p)
+				return
 			}
-			addCacheVideo(video)
-		case <-ctx.Done():
-			return
 		}
+		video, err := genVideoPreview(ctx, ffprobe, ffmpeg, v, cacheDir, i+previewQueue.Len(), i, ps, sc)
+		i++
+		if err != nil {
+			previewQueue.Done(p)
+			fmt.Printf("视频预览生成失败: %+v\n", err)
+			continue
+		}
+		addCacheVideo(video)
+		previewQueue.Done(p)
+		writeCache(cacheF)
 	}
 }
 
-func genVideoInfo(ctx context.Context, ffprobe, ffmpeg, path, cacheDir string, count, cur int, ps *ProgressServer) (*Video, error) {
-	v, err := VideoInfo(ffprobe, path)
-	if err != nil {
-		return nil, err
-	}
+// 生成视频的预览, 返回新的视频信息, 原来的视频信息可能正在被读取, 不修改
+func genVideoPreview(ctx context.Context, ffprobe, ffmpeg string, video *Video, cacheDir string, count, cur int, ps *ProgressServer, sc ScanConfig) (*Video, error) {
+	v := video.Clone()
+	path := v.Path
 
 	previewDir, err := ioutil.TempDir(cacheDir, "")
 	if err != nil {
@@ -280,11 +549,40 @@ func genVideoInfo(ctx context.Context, ffprobe, ffmpeg, path, cacheDir string, c
 	})
 
 	cw, ch := AdjustAspectRatio(v.Width, v.Height, 412, 232)
+	toneMap := ToneMapFilter(ffmpeg, v)
 	v.Preview, err = GenVideoPreview(ctx, v.Duration, ffmpeg, path, previewDir, ps.Addr(), PreviewConfig{
 		spf: 5, maxF: 100, width: 1600, height: 900, cW: cw, cH: ch, perW: 160, perH: 90,
+		mode: sc.PreviewMode, sceneThreshold: sc.SceneThreshold, pipe: sc.PipeFrames,
+		output: sc.ImageOutput, toneMap: toneMap,
 	})
 	if err != nil {
 		return nil, err
 	}
+
+	// 封面, 章节缩略图和字幕生成失败不影响视频
+	order := sc.CoverOrder
+	if len(order) == 0 {
+		order = []string{CoverFrame}
+	}
+	coverW, coverH := CoverSize(v)
+	source, err := ResolveCover(ctx, ffprobe, ffmpeg, v, order, coverW, coverH, sc.ImageOutput)
+	if err != nil {
+		fmt.Printf("封面生成失败: %+v\n", err)
+	} else {
+		v.Preview.CoverSource = source
+	}
+	if err := UpdateCoverPlaceholder(v.Preview); err != nil {
+		fmt.Printf("封面占位生成失败: %+v\n", err)
+	}
+
+	err = GenChapterThumbs(ctx, ffmpeg, path, filepath.Join(previewDir, "chapters"), v.Chapters, cw, ch, toneMap)
+	if err != nil {
+		fmt.Printf("章节缩略图生成失败: %+v\n", err)
+	}
+
+	v.Subtitles, err = GenSubtitles(ctx, ffprobe, ffmpeg, path, filepath.Join(previewDir, "subtitles"))
+	if err != nil {
+		fmt.Printf("字幕生成失败: %+v\n", err)
+	}
 	return v, nil
 }
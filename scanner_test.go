@@ -1,8 +1,97 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestScanVideos(t *testing.T) {
 	ScanVideos([]string{"/Users/zoukai/Downloads"}, "/Users/zoukai/temp/", "ffprobe", "ffmpeg")
 	<-done
-}
\ No newline at end of file
+}
+
+func TestRemoveNotExistVideos(t *testing.T) {
+	root, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	online := filepath.Join(root, "online")
+	offline := filepath.Join(root, "offline")
+	os.MkdirAll(online, os.ModePerm)
+	exists := filepath.Join(online, "exists.mp4")
+	ioutil.WriteFile(exists, []byte{}, os.ModePerm)
+
+	libs := []*Library{{Dir: online}, {Dir: offline}}
+	c := &cacheInfo{Mod: map[string]time.Time{}, Videos: map[string]*Video{}}
+	for _, p := range []string{exists, filepath.Join(online, "deleted.mp4"), filepath.Join(offline, "a.mp4"), filepath.Join(root, "other.mp4")} {
+		c.AddVideo(&Video{Path: p})
+	}
+
+	c.RemoveNotExistVideos(libs, CheckLibraries(libs), time.Hour)
+	if v := c.Videos[exists]; v == nil || v.Unavailable {
+		t.Errorf("存在的视频不应该被移除或标记: %+v", v)
+	}
+	if v := c.Videos[filepath.Join(online, "deleted.mp4")]; v == nil || !v.Unavailable {
+		t.Errorf("宽限期内的视频应该保留并标记: %+v", v)
+	}
+	if v := c.Videos[filepath.Join(offline, "a.mp4")]; v == nil || !v.Unavailable {
+		t.Errorf("离线库的视频应该保留并标记: %+v", v)
+	}
+	if v := c.Videos[filepath.Join(root, "other.mp4")]; v != nil {
+		t.Errorf("不属于任何库的视频应该被移除: %+v", v)
+	}
+
+	c.RemoveNotExistVideos(libs, CheckLibraries(libs), 0)
+	if v := c.Videos[filepath.Join(online, "deleted.mp4")]; v != nil {
+		t.Errorf("超过宽限期的视频应该被移除: %+v", v)
+	}
+	if v := c.Videos[filepath.Join(offline, "a.mp4")]; v == nil {
+		t.Errorf("离线库的视频应该保留")
+	}
+}
+
+func TestRemoveNotExistVideosEmptyLibrary(t *testing.T) {
+	root, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// 挂载点存在但是没有挂载上, 目录是空的
+	mount := filepath.Join(root, "mount")
+	os.MkdirAll(mount, os.ModePerm)
+	p := filepath.Join(mount, "a.mp4")
+
+	libs := []*Library{{Dir: mount}}
+	c := &cacheInfo{Mod: map[string]time.Time{p: time.Now()}, Videos: map[string]*Video{}}
+	old := &Video{Path: p}
+	c.AddVideo(old)
+
+	online := CheckLibraries(libs)
+	if online[mount] {
+		t.Fatalf("空的挂载点应该是离线的")
+	}
+	c.RemoveNotExistVideos(libs, online, 0)
+	v := c.Videos[p]
+	if v == nil || !v.Unavailable {
+		t.Fatalf("空的挂载点中的视频应该保留并标记: %+v", v)
+	}
+	if _, ok := c.Mod[p]; !ok {
+		t.Errorf("空的挂载点中的视频修改时间应该保留")
+	}
+	if old.Unavailable {
+		t.Errorf("不应该修改原来的视频信息")
+	}
+
+	// 重新挂载后恢复可用
+	ioutil.WriteFile(p, []byte{}, os.ModePerm)
+	c.RemoveNotExistVideos(libs, CheckLibraries(libs), 0)
+	if v := c.Videos[p]; v == nil || v.Unavailable {
+		t.Errorf("重新在线后视频应该可用: %+v", v)
+	}
+}
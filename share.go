@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分享链接的默认有效期和最长有效期
+const (
+	defaultShareTTL = 72 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// 打开分享后播放, 封面, 字幕地址的有效期, 一次观看用这个地址
+const shareGrantTTL = 6 * time.Hour
+
+// 分享链接和观看授权签名内容的前缀, 和播放链接的 token 区分开, 互相不能代替
+const (
+	shareTokenPrefix = "share:"
+	shareGrantPrefix = "grant:"
+)
+
+// 分享链接, 不需要登录就可以观看一个视频, 只能访问视频本身, 封面和字幕
+type Share struct {
+	ID      string    `json:"id"`
+	Video   string    `json:"video"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// 最多打开几次, 0 不限制
+	MaxViews int `json:"maxViews"`
+	Views    int `json:"views"`
+}
+
+// 分享是否还能打开
+func (s *Share) Valid(now time.Time) bool {
+	return now.Before(s.Expires) && (s.MaxViews == 0 || s.Views < s.MaxViews)
+}
+
+// 分享链接签名的内容, 链接本身带有过期时间, 撤销后分享不存在也会失效
+type shareClaims struct {
+	Share   string `json:"s"`
+	Expires int64  `json:"e"`
+}
+
+// 打开分享后的观看授权, 播放, 封面, 字幕只接受授权, 不接受分享链接的 token
+type shareGrant struct {
+	Grant   string `json:"g"`
+	Expires int64  `json:"e"`
+}
+
+// 分享链接, 和视频信息缓存放在一起
+type shareStore struct {
+	mu   sync.RWMutex
+	path string
+
+	Shares map[string]*Share `json:"shares"`
+}
+
+var shares = newShareStore("")
+
+func newShareStore(path string) *shareStore {
+	return &shareStore{path: path, Shares: map[string]*Share{}}
+}
+
+// 读取分享链接, 文件不存在时为空
+func LoadShares(path string) error {
+	s := newShareStore(path)
+	if IsFileExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取分享链接失败")
+		}
+		if err = json.Unmarshal(data, s); err != nil {
+			return errors.WithMessage(err, "解析分享链接失败")
+		}
+	}
+	shares = s
+	return nil
+}
+
+// 保存, 调用时需要持有锁, 顺便清理过期的分享
+func (s *shareStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	now := time.Now()
+	for k, v := range s.Shares {
+		if now.After(v.Expires) {
+			delete(s.Shares, k)
+		}
+	}
+	return saveJSON(s.path, s, "分享链接")
+}
+
+// 创建分享, 返回分享和链接的 token
+func (s *shareStore) Create(owner, video string, ttl time.Duration, maxViews int) (Share, string, error) {
+	if ttl <= 0 || ttl > maxShareTTL {
+		return Share{}, "", NewError(ErrBadRequest, "有效期错误: %v", ttl)
+	}
+	if maxViews < 0 {
+		return Share{}, "", NewError(ErrBadRequest, "次数限制错误: %v", maxViews)
+	}
+	now := time.Now()
+	share := &Share{ID: randomToken(8), Video: video, Owner: owner, Created: now, Expires: now.Add(ttl), MaxViews: maxViews}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Shares[share.ID] = share
+	return *share, shareToken(share), s.save()
+}
+
+func shareToken(share *Share) string {
+	data, _ := json.Marshal(shareClaims{Share: share.ID, Expires: share.Expires.Unix()})
+	return Sign(shareTokenPrefix + string(data))
+}
+
+// 验证链接的 token, 返回有效的分享
+func (s *shareStore) Resolve(token string, now time.Time) (Share, bool) {
+	payload, ok := Verify(token)
+	if !ok || !strings.HasPrefix(payload, shareTokenPrefix) {
+		return Share{}, false
+	}
+	var c shareClaims
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(payload, shareTokenPrefix)), &c); err != nil || c.Share == "" || now.Unix() > c.Expires {
+		return Share{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	share, ok := s.Shares[c.Share]
+	if !ok || !share.Valid(now) {
+		return Share{}, false
+	}
+	return *share, true
+}
+
+// 生成一次观看的授权, 不超过分享的有效期
+func (s *shareStore) Grant(share Share, now time.Time) string {
+	expires := now.Add(shareGrantTTL)
+	if share.Expires.Before(expires) {
+		expires = share.Expires
+	}
+	data, _ := json.Marshal(shareGrant{Grant: share.ID, Expires: expires.Unix()})
+	return Sign(shareGrantPrefix + string(data))
+}
+
+// 验证观看授权, 分享撤销或过期后授权也失效
+func (s *shareStore) ResolveGrant(grant string, now time.Time) (Share, bool) {
+	payload, ok := Verify(grant)
+	if !ok || !strings.HasPrefix(payload, shareGrantPrefix) {
+		return Share{}, false
+	}
+	var g shareGrant
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(payload, shareGrantPrefix)), &g); err != nil || g.Grant == "" || now.Unix() > g.Expires {
+		return Share{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	share, ok := s.Shares[g.Grant]
+	if !ok || !now.Before(share.Expires) {
+		return Share{}, false
+	}
+	return *share, true
+}
+
+// 记录打开了一次, 超过次数限制返回 false
+func (s *shareStore) View(id string) (Share, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.Shares[id]
+	if !ok || (share.MaxViews > 0 && share.Views >= share.MaxViews) {
+		return Share{}, false, nil
+	}
+	share.Views++
+	return *share, true, s.save()
+}
+
+// 用户创建的分享, 管理员可以看到所有的分享, 最新的在前面
+func (s *shareStore) List(u *UserInfo, now time.Time) []Share {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []Share{}
+	for _, share := range s.Shares {
+		if (u.Admin || share.Owner == u.Name) && now.Before(share.Expires) {
+			res = append(res, *share)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.After(res[j].Created)
+	})
+	return res
+}
+
+// 撤销分享, 只有创建者和管理员可以撤销
+func (s *shareStore) Revoke(u *UserInfo, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.Shares[id]
+	if !ok || (share.Owner != u.Name && !u.Admin) {
+		return NewError(ErrNotFound, "分享不存在: %v", id)
+	}
+	delete(s.Shares, id)
+	return s.save()
+}
+
+// 删除用户创建的分享
+func (s *shareStore) DeleteUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.Shares {
+		if v.Owner == user {
+			delete(s.Shares, k)
+		}
+	}
+	return s.save()
+}
+
+// 分享链接的地址
+func shareURL(r *http.Request, token string) string {
+	return baseURL(r) + "/share/" + token
+}
+
+// 创建者是否还可以访问视频, 访问规则修改后分享也会失效, 隐藏的库不能分享
+func shareAccessible(owner string, v *Video) bool {
+	u, ok := users.Get(owner)
+	return ok && users.CanAccess(&u, false, conf.Libraries, v.Path)
+}
+
+// 分享对应的视频, 分享无效, 视频不存在或者创建者不能访问时写入错误
+func sharedVideo(w http.ResponseWriter, r *http.Request, share Share, ok bool) (Share, *Video) {
+	if !ok {
+		WriteError(w, r, NewError(ErrNotFound, "分享不存在或已经过期"))
+		return share, nil
+	}
+	v := VideoByID(share.Video)
+	if v == nil || !shareAccessible(share.Owner, v) {
+		WriteError(w, r, NewError(ErrNotFound, "视频不存在"))
+		return share, nil
+	}
+	return share, v
+}
+
+// 观看授权对应的视频
+func grantedVideo(w http.ResponseWriter, r *http.Request) *Video {
+	share, ok := shares.ResolveGrant(mux.Vars(r)["grant"], time.Now())
+	_, v := sharedVideo(w, r, share, ok)
+	return v
+}
+
+// 创建视频的分享链接, expires 为有效期, 默认72小时, maxViews 为最多打开几次
+func AddShare(w http.ResponseWriter, r *http.Request) {
+	v := accessibleVideo(w, r)
+	if v == nil {
+		return
+	}
+	if !shareAccessible(CurrentUser(r).Name, v) {
+		WriteError(w, r, NewError(ErrForbidden, "隐藏库中的视频不能分享"))
+		return
+	}
+	req := struct {
+		Expires  string `json:"expires"`
+		MaxViews int    `json:"maxViews"`
+	}{}
+	if err := readJson(r, &req); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	ttl := defaultShareTTL
+	if req.Expires != "" {
+		d, err := time.ParseDuration(req.Expires)
+		if err != nil {
+			WriteError(w, r, NewError(ErrBadRequest, "有效期错误"))
+			return
+		}
+		ttl = d
+	}
+	share, token, err := shares.Create(CurrentUser(r).Name, v.ID, ttl, req.MaxViews)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, struct {
+		Share
+		URL string `json:"url"`
+	}{share, shareURL(r, token)})
+}
+
+// 获取当前用户的分享
+func GetShares(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, shares.List(CurrentUser(r), time.Now()))
+}
+
+// 撤销分享
+func RemoveShare(w http.ResponseWriter, r *http.Request) {
+	if err := shares.Revoke(CurrentUser(r), mux.Vars(r)["sid"]); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 打开分享链接, 计一次打开次数, 返回视频的信息和这次观看使用的播放, 封面, 字幕的地址
+func GetShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := shares.Resolve(mux.Vars(r)["token"], time.Now())
+	share, v := sharedVideo(w, r, share, ok)
+	if v == nil {
+		return
+	}
+	share, ok, err := shares.View(share.ID)
+	if err != nil {
+		log.Printf("记录分享打开次数失败: %+v", err)
+	}
+	if !ok {
+		WriteError(w, r, NewError(ErrNotFound, "分享的次数已经用完"))
+		return
+	}
+
+	base := shareURL(r, shares.Grant(share, time.Now()))
+	type subtitle struct {
+		ID    string `json:"id"`
+		Lang  string `json:"lang"`
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	}
+	subs := []subtitle{}
+	for _, s := range v.Subtitles {
+		subs = append(subs, subtitle{s.ID, s.Lang, s.Title, base + "/subtitles/" + s.ID})
+	}
+	OkCode(w, struct {
+		Name      string        `json:"name"`
+		Duration  time.Duration `json:"duration"`
+		Width     int           `json:"width"`
+		Height    int           `json:"height"`
+		Stream    string        `json:"stream"`
+		Cover     string        `json:"cover"`
+		Subtitles []subtitle    `json:"subtitles"`
+		Expires   time.Time     `json:"expires"`
+		Views     int           `json:"views"`
+		MaxViews  int           `json:"maxViews"`
+	}{v.Name, v.Duration, v.Width, v.Height, base + "/stream", base + "/cover", subs, share.Expires, share.Views, share.MaxViews})
+}
+
+// 播放分享的视频
+func GetShareStream(w http.ResponseWriter, r *http.Request) {
+	if v := grantedVideo(w, r); v != nil {
+		http.ServeFile(w, r, v.Path)
+	}
+}
+
+// 分享的视频的封面
+func GetShareCover(w http.ResponseWriter, r *http.Request) {
+	v := grantedVideo(w, r)
+	if v == nil {
+		return
+	}
+	if v.Preview == nil {
+		WriteError(w, r, NewError(ErrNotFound, "封面还没有生成"))
+		return
+	}
+	http.ServeFile(w, r, v.Preview.Cover)
+}
+
+// 分享的视频的字幕
+func GetShareSubtitle(w http.ResponseWriter, r *http.Request) {
+	v := grantedVideo(w, r)
+	if v == nil {
+		return
+	}
+	sub := v.Subtitle(mux.Vars(r)["sid"])
+	if sub == nil {
+		WriteError(w, r, NewError(ErrNotFound, "字幕不存在"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeFile(w, r, sub.Path)
+}
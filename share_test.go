@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStore(t *testing.T) {
+	old := signKey
+	defer func() { signKey = old }()
+	signKey = []byte(strings.Repeat("k", 32))
+
+	s := newShareStore("")
+	now := time.Now()
+	_, token, err := s.Create("alice", "v1", time.Hour, 2)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	share, ok := s.Resolve(token, now)
+	if !ok || share.Video != "v1" {
+		t.Fatalf("Resolve() = %v, %v", share, ok)
+	}
+	if _, ok = s.Resolve(token, now.Add(2*time.Hour)); ok {
+		t.Errorf("Resolve() 过期的分享应该失败")
+	}
+	if _, ok = s.Resolve(token+"x", now); ok {
+		t.Errorf("Resolve() 修改过的链接应该失败")
+	}
+
+	// 分享链接不能直接播放, 观看授权不能当作分享链接
+	if _, ok = s.ResolveGrant(token, now); ok {
+		t.Errorf("ResolveGrant() 分享链接不能当作授权")
+	}
+	grant := s.Grant(share, now)
+	if _, ok = s.Resolve(grant, now); ok {
+		t.Errorf("Resolve() 授权不能当作分享链接")
+	}
+	if _, ok = s.ResolveGrant(grant, now.Add(shareGrantTTL+time.Minute)); ok {
+		t.Errorf("ResolveGrant() 过期的授权应该失败")
+	}
+
+	// 签名内容带有类型前缀, 其他类型或者没有前缀的 token 不能使用
+	bare := Sign(fmt.Sprintf(`{"s":%q,"g":%q,"v":"v1","e":%d}`, share.ID, share.ID, now.Add(time.Hour).Unix()))
+	if _, ok = s.Resolve(bare, now); ok {
+		t.Errorf("Resolve() 没有前缀的 token 应该失败")
+	}
+	if _, ok = s.ResolveGrant(bare, now); ok {
+		t.Errorf("ResolveGrant() 没有前缀的 token 应该失败")
+	}
+	if _, ok = verifyStreamToken(bare, "v1", now); ok {
+		t.Errorf("verifyStreamToken() 没有前缀的 token 应该失败")
+	}
+	stream := streamToken("alice", share.ID, false, now.Add(time.Hour))
+	if _, ok = s.Resolve(stream, now); ok {
+		t.Errorf("Resolve() 播放链接不能当作分享链接")
+	}
+	if _, ok = s.ResolveGrant(stream, now); ok {
+		t.Errorf("ResolveGrant() 播放链接不能当作授权")
+	}
+	if _, ok = verifyStreamToken(grant, "v1", now); ok {
+		t.Errorf("verifyStreamToken() 授权不能当作播放链接")
+	}
+
+	// 次数用完后不能再打开, 已经打开的这次还可以继续播放
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := s.View(share.ID); !ok {
+			t.Fatalf("View() 第%v次应该成功", i+1)
+		}
+	}
+	if _, ok, _ := s.View(share.ID); ok {
+		t.Errorf("View() 次数用完应该失败")
+	}
+	if _, ok = s.Resolve(token, now); ok {
+		t.Errorf("Resolve() 次数用完后应该失败")
+	}
+	if _, ok = s.ResolveGrant(grant, now); !ok {
+		t.Errorf("ResolveGrant() 已经打开的授权应该还可以播放")
+	}
+
+	bob := &UserInfo{Name: "bob"}
+	if got := s.List(bob, now); len(got) != 0 {
+		t.Errorf("List() 其他用户 = %v", got)
+	}
+	if got := s.List(&UserInfo{Name: "admin", Admin: true}, now); len(got) != 1 {
+		t.Errorf("List() 管理员 = %v", got)
+	}
+	if err = s.Revoke(bob, share.ID); err == nil {
+		t.Errorf("Revoke() 其他用户不能撤销")
+	}
+	if err = s.Revoke(&UserInfo{Name: "alice"}, share.ID); err != nil {
+		t.Errorf("Revoke() error = %v", err)
+	}
+	if _, ok = s.ResolveGrant(grant, now); ok {
+		t.Errorf("ResolveGrant() 撤销后应该失败")
+	}
+}
+
+func TestShareAccessible(t *testing.T) {
+	oldUsers, oldConf := users, conf
+	defer func() { users, conf = oldUsers, oldConf }()
+	users = newUserStore("")
+	conf.Libraries = []*Library{{Dir: "/media/movies"}, {Dir: "/media/secret", Hidden: true}}
+	users.Create("alice", "password1", false)
+	users.Create("admin", "password1", true)
+
+	movie := &Video{Path: "/media/movies/a.mkv"}
+	secret := &Video{Path: "/media/secret/b.mkv"}
+	if !shareAccessible("alice", movie) {
+		t.Errorf("shareAccessible() 可以访问的视频应该成功")
+	}
+	if shareAccessible("admin", secret) {
+		t.Errorf("shareAccessible() 隐藏的库不能分享")
+	}
+	if shareAccessible("bob", movie) {
+		t.Errorf("shareAccessible() 删除的用户应该失败")
+	}
+	// 分享后访问规则修改, 分享也失效
+	if err := users.SetAccessRules([]*AccessRule{{Path: "/media/movies", Users: []string{"admin"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if shareAccessible("alice", movie) {
+		t.Errorf("shareAccessible() 没有权限后应该失败")
+	}
+}
+
+func TestShareCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		maxViews int
+		wantErr  bool
+	}{
+		{"正常", time.Hour, 0, false},
+		{"有效期为零", 0, 0, true},
+		{"有效期太长", maxShareTTL + time.Hour, 0, true},
+		{"次数为负", time.Hour, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := newShareStore("").Create("alice", "v1", tt.ttl, tt.maxViews); (err != nil) != tt.wantErr {
+				t.Errorf("Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"strings"
+)
+
+// 签名使用的密钥, 保存在缓存目录, 重新生成后之前签名的链接全部失效
+var signKey []byte
+
+// 读取签名密钥, 不存在时生成
+func LoadSignKey(path string) error {
+	if IsFileExists(path) {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取签名密钥失败")
+		}
+		if len(key) < 32 {
+			return errors.Errorf("签名密钥太短: %v", path)
+		}
+		signKey = key
+		return nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := MkParentDir(path); err != nil {
+		return errors.WithMessage(err, "创建签名密钥失败")
+	}
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return errors.WithMessage(err, "写入签名密钥失败")
+	}
+	signKey = key
+	return nil
+}
+
+func signature(payload string) []byte {
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// 签名, 返回 内容.签名, 都是 base64url 编码
+func Sign(payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(signature(payload))
+}
+
+// 验证签名, 返回签名的内容
+func Verify(token string) (string, bool) {
+	if len(signKey) == 0 {
+		return "", false
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(token[:i])
+	if err != nil {
+		return "", false
+	}
+	sig, err := enc.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, signature(string(payload))) {
+		return "", false
+	}
+	return string(payload), true
+}
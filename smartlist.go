@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 智能播放列表的一个条件
+type smartCond struct {
+	negate bool
+	match  func(v *UserVideo, now time.Time) bool
+}
+
+// 智能播放列表的查询, 语法见 README
+// 条件之间是并且的关系, OR 分开的条件组之间是或者的关系
+type SmartQuery struct {
+	groups [][]smartCond
+	sort   string
+	desc   bool
+	limit  int
+}
+
+// 分割查询, 双引号中的空格不分割
+func splitQuery(s string) []string {
+	var tokens []string
+	var b strings.Builder
+	quoted, has := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			has = true
+		case unicode.IsSpace(r) && !quoted:
+			if has {
+				tokens = append(tokens, b.String())
+				b.Reset()
+				has = false
+			}
+		default:
+			b.WriteRune(r)
+			has = true
+		}
+	}
+	if has {
+		tokens = append(tokens, b.String())
+	}
+	return tokens
+}
+
+// 解析查询
+func ParseSmartQuery(s string) (*SmartQuery, error) {
+	q := &SmartQuery{groups: [][]smartCond{nil}}
+	for _, tok := range splitQuery(s) {
+		switch {
+		case tok == "OR":
+			q.groups = append(q.groups, nil)
+			continue
+		case strings.HasPrefix(tok, "sort:"):
+			field := strings.TrimPrefix(tok, "sort:")
+			q.desc = strings.HasPrefix(field, "-")
+			q.sort = strings.TrimPrefix(field, "-")
+			if smartSorts[q.sort] == nil {
+				return nil, NewError(ErrBadRequest, "不支持的排序: %v", q.sort)
+			}
+			continue
+		case strings.HasPrefix(tok, "limit:"):
+			n, err := strconv.Atoi(strings.TrimPrefix(tok, "limit:"))
+			if err != nil || n <= 0 {
+				return nil, NewError(ErrBadRequest, "数量限制错误: %v", tok)
+			}
+			q.limit = n
+			continue
+		}
+
+		cond, err := parseSmartCond(tok)
+		if err != nil {
+			return nil, err
+		}
+		last := len(q.groups) - 1
+		q.groups[last] = append(q.groups[last], cond)
+	}
+	for _, g := range q.groups {
+		if len(g) == 0 && len(q.groups) > 1 {
+			return nil, NewError(ErrBadRequest, "OR 两边都需要条件")
+		}
+	}
+	return q, nil
+}
+
+// 不带值的条件
+var smartKeywords = map[string]func(v *UserVideo, now time.Time) bool{
+	"watched":    func(v *UserVideo, now time.Time) bool { return v.Watched },
+	"unwatched":  func(v *UserVideo, now time.Time) bool { return !v.Watched },
+	"inprogress": func(v *UserVideo, now time.Time) bool { return v.Position > 0 && !v.Watched },
+	"favorite":   func(v *UserVideo, now time.Time) bool { return v.Favorite },
+	"hdr":        func(v *UserVideo, now time.Time) bool { return v.HDR != "" },
+}
+
+// 文本条件, 不区分大小写
+var smartTexts = map[string]func(v *UserVideo, value string) bool{
+	"tag": func(v *UserVideo, value string) bool {
+		for _, t := range v.Tags {
+			if strings.EqualFold(t, value) {
+				return true
+			}
+		}
+		return false
+	},
+	"name":  func(v *UserVideo, value string) bool { return containsFold(v.Name, value) },
+	"path":  func(v *UserVideo, value string) bool { return containsFold(v.Path, value) },
+	"codec": func(v *UserVideo, value string) bool { return strings.EqualFold(v.VideoCodec, value) },
+	"audio": func(v *UserVideo, value string) bool { return strings.EqualFold(v.AudioCodec, value) },
+}
+
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// 数值条件, 返回视频的值和解析条件的值的方法
+type smartNumber struct {
+	value func(v *UserVideo, now time.Time) float64
+	parse func(s string) (float64, error)
+}
+
+var smartNumbers = map[string]smartNumber{
+	// 添加了多久
+	"added": {func(v *UserVideo, now time.Time) float64 {
+		if v.Added.IsZero() {
+			return float64(1<<63 - 1)
+		}
+		return float64(now.Sub(v.Added))
+	}, parseAge},
+	"duration": {func(v *UserVideo, now time.Time) float64 { return float64(v.Duration) }, parseSmartDuration},
+	"size":     {func(v *UserVideo, now time.Time) float64 { return float64(v.Size) }, parseSmartSize},
+	"width":    {func(v *UserVideo, now time.Time) float64 { return float64(v.Width) }, parseSmartInt},
+	"height":   {func(v *UserVideo, now time.Time) float64 { return float64(v.Height) }, parseSmartInt},
+	// 分辨率按长边比较, 竖屏的视频也一样
+	"resolution": {func(v *UserVideo, now time.Time) float64 {
+		if v.Width > v.Height {
+			return float64(v.Width)
+		}
+		return float64(v.Height)
+	}, parseResolution},
+}
+
+// 比较运算符, 长的在前面
+var smartOps = []string{">=", "<=", ">", "<", "="}
+
+func parseSmartCond(tok string) (smartCond, error) {
+	cond := smartCond{}
+	if strings.HasPrefix(tok, "-") && len(tok) > 1 {
+		cond.negate = true
+		tok = tok[1:]
+	}
+
+	if fn, ok := smartKeywords[tok]; ok {
+		cond.match = fn
+		return cond, nil
+	}
+
+	if i := strings.Index(tok, ":"); i > 0 {
+		field, value := tok[:i], tok[i+1:]
+		fn, ok := smartTexts[field]
+		if !ok {
+			return cond, NewError(ErrBadRequest, "不支持的条件: %v", tok)
+		}
+		cond.match = func(v *UserVideo, now time.Time) bool { return fn(v, value) }
+		return cond, nil
+	}
+
+	for _, op := range smartOps {
+		i := strings.Index(tok, op)
+		if i <= 0 {
+			continue
+		}
+		field, value := tok[:i], tok[i+len(op):]
+		num, ok := smartNumbers[field]
+		if !ok {
+			return cond, NewError(ErrBadRequest, "不支持的条件: %v", tok)
+		}
+		n, err := num.parse(value)
+		if err != nil {
+			return cond, NewError(ErrBadRequest, "条件的值错误: %v", tok)
+		}
+		op := op
+		cond.match = func(v *UserVideo, now time.Time) bool { return compare(num.value(v, now), op, n) }
+		return cond, nil
+	}
+	return cond, NewError(ErrBadRequest, "不支持的条件: %v", tok)
+}
+
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	default:
+		return a == b
+	}
+}
+
+// 解析时长, 除了 time.ParseDuration 的格式, 还支持天 d 和周 w, 如 7d, 2w
+func parseAge(s string) (float64, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			return n * float64(unit), err
+		}
+	}
+	return parseSmartDuration(s)
+}
+
+func parseSmartDuration(s string) (float64, error) {
+	d, err := time.ParseDuration(s)
+	return float64(d), err
+}
+
+// 解析大小, 支持 K, M, G, T 单位, 按1024计算
+func parseSmartSize(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	unit := 1.0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		unit = float64(int64(1) << (10 * uint(strings.IndexByte("KMGT", s[i])+1)))
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n * unit, err
+}
+
+func parseSmartInt(s string) (float64, error) {
+	n, err := strconv.Atoi(s)
+	return float64(n), err
+}
+
+// 分辨率的名字对应的长边
+var resolutionNames = map[string]int{
+	"480p": 854, "720p": 1280, "1080p": 1920, "1440p": 2560, "2k": 2560, "2160p": 3840, "4k": 3840, "8k": 7680,
+}
+
+func parseResolution(s string) (float64, error) {
+	if n, ok := resolutionNames[strings.ToLower(s)]; ok {
+		return float64(n), nil
+	}
+	return parseSmartInt(s)
+}
+
+// 排序的字段, 返回 a 是否在 b 前面
+var smartSorts = map[string]func(a, b *UserVideo) bool{
+	"added":    func(a, b *UserVideo) bool { return a.Added.Before(b.Added) },
+	"duration": func(a, b *UserVideo) bool { return a.Duration < b.Duration },
+	"size":     func(a, b *UserVideo) bool { return a.Size < b.Size },
+	"name":     func(a, b *UserVideo) bool { return a.Name < b.Name },
+	"watched":  func(a, b *UserVideo) bool { return a.Updated.Before(b.Updated) },
+}
+
+// 是否满足查询
+func (q *SmartQuery) Match(v *UserVideo, now time.Time) bool {
+	for _, g := range q.groups {
+		ok := true
+		for _, c := range g {
+			if c.match(v, now) == c.negate {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 过滤, 排序和限制数量
+func (q *SmartQuery) Apply(videos []*UserVideo, now time.Time) []*UserVideo {
+	res := make([]*UserVideo, 0)
+	for _, v := range videos {
+		if q.Match(v, now) {
+			res = append(res, v)
+		}
+	}
+	if less := smartSorts[q.sort]; less != nil {
+		sort.SliceStable(res, func(i, j int) bool {
+			if q.desc {
+				return less(res[j], res[i])
+			}
+			return less(res[i], res[j])
+		})
+	}
+	if q.limit > 0 && len(res) > q.limit {
+		res = res[:q.limit]
+	}
+	return res
+}
+
+// 保存的智能播放列表
+type SmartPlaylist struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Query   string    `json:"query"`
+	Created time.Time `json:"created"`
+}
+
+// 智能播放列表, 每个用户自己的, 和视频信息缓存放在一起
+type smartStore struct {
+	mu   sync.RWMutex
+	path string
+
+	// 用户 -> 列表id -> 列表
+	Users map[string]map[string]*SmartPlaylist `json:"users"`
+}
+
+var smartLists = newSmartStore("")
+
+func newSmartStore(path string) *smartStore {
+	return &smartStore{path: path, Users: map[string]map[string]*SmartPlaylist{}}
+}
+
+// 读取智能播放列表, 文件不存在时为空
+func LoadSmartLists(path string) error {
+	s := newSmartStore(path)
+	if IsFileExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取播放列表失败")
+		}
+		if err = json.Unmarshal(data, s); err != nil {
+			return errors.WithMessage(err, "解析播放列表失败")
+		}
+	}
+	smartLists = s
+	return nil
+}
+
+// 保存, 调用时需要持有锁
+func (s *smartStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveJSON(s.path, s, "播放列表")
+}
+
+// 用户的所有播放列表, 按创建时间排序
+func (s *smartStore) All(user string) []SmartPlaylist {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]SmartPlaylist, 0, len(s.Users[user]))
+	for _, p := range s.Users[user] {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res
+}
+
+// 获取播放列表, 不存在返回 false
+func (s *smartStore) Get(user, id string) (SmartPlaylist, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.Users[user][id]
+	if !ok {
+		return SmartPlaylist{}, false
+	}
+	return *p, true
+}
+
+// 检查名字和查询
+func validSmartPlaylist(name, query string) error {
+	if strings.TrimSpace(name) == "" {
+		return NewError(ErrBadRequest, "播放列表名字不能为空")
+	}
+	_, err := ParseSmartQuery(query)
+	return err
+}
+
+// 保存播放列表, id 为空时创建
+func (s *smartStore) Save(user string, p SmartPlaylist) (SmartPlaylist, error) {
+	if err := validSmartPlaylist(p.Name, p.Query); err != nil {
+		return SmartPlaylist{}, err
+	}
+	p.Name = strings.TrimSpace(p.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lists := s.Users[user]
+	if lists == nil {
+		lists = map[string]*SmartPlaylist{}
+		s.Users[user] = lists
+	}
+	if p.ID == "" {
+		p.ID = randomToken(8)
+		p.Created = time.Now()
+	} else if old, ok := lists[p.ID]; ok {
+		p.Created = old.Created
+	} else {
+		return SmartPlaylist{}, NewError(ErrNotFound, "播放列表不存在: %v", p.ID)
+	}
+	lists[p.ID] = &p
+	return p, s.save()
+}
+
+// 删除播放列表
+func (s *smartStore) Delete(user, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Users[user][id]; !ok {
+		return NewError(ErrNotFound, "播放列表不存在: %v", id)
+	}
+	delete(s.Users[user], id)
+	return s.save()
+}
+
+// 删除用户的播放列表
+func (s *smartStore) DeleteUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Users, user)
+	return s.save()
+}
+
+// 当前用户的播放列表的视频
+func smartPlaylistVideos(w http.ResponseWriter, r *http.Request) (SmartPlaylist, []*UserVideo, bool) {
+	p, ok := smartLists.Get(CurrentUser(r).Name, mux.Vars(r)["pid"])
+	if !ok {
+		WriteError(w, r, NewError(ErrNotFound, "播放列表不存在"))
+		return p, nil, false
+	}
+	q, err := ParseSmartQuery(p.Query)
+	if err != nil {
+		WriteError(w, r, err)
+		return p, nil, false
+	}
+	return p, q.Apply(currentUserVideos(r), time.Now()), true
+}
+
+// 获取当前用户的所有播放列表
+func GetSmartPlaylists(w http.ResponseWriter, r *http.Request) {
+	OkCode(w, smartLists.All(CurrentUser(r).Name))
+}
+
+// 获取播放列表和列表中的视频
+func GetSmartPlaylist(w http.ResponseWriter, r *http.Request) {
+	p, videos, ok := smartPlaylistVideos(w, r)
+	if !ok {
+		return
+	}
+	OkCode(w, struct {
+		SmartPlaylist
+		Videos []*UserVideo `json:"videos"`
+	}{p, videos})
+}
+
+// 下载播放列表文件, 格式为 m3u8 或 xspf
+func GetSmartPlaylistFile(w http.ResponseWriter, r *http.Request) {
+	p, videos, ok := smartPlaylistVideos(w, r)
+	if !ok {
+		return
+	}
+	WritePlaylist(w, r, mux.Vars(r)["format"], p.Name, videos)
+}
+
+// 创建或修改播放列表
+func SaveSmartPlaylist(w http.ResponseWriter, r *http.Request) {
+	var p SmartPlaylist
+	if err := readJson(r, &p); err != nil {
+		WriteError(w, r, NewError(ErrBadRequest, "请求格式错误"))
+		return
+	}
+	p.ID = mux.Vars(r)["pid"]
+	p, err := smartLists.Save(CurrentUser(r).Name, p)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, p)
+}
+
+// 删除播放列表
+func RemoveSmartPlaylist(w http.ResponseWriter, r *http.Request) {
+	if err := smartLists.Delete(CurrentUser(r).Name, mux.Vars(r)["pid"]); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	OkCode(w, nil)
+}
+
+// 按查询搜索视频, 不保存
+func searchVideos(w http.ResponseWriter, r *http.Request, videos []*UserVideo) ([]*UserVideo, bool) {
+	qs := r.URL.Query().Get("q")
+	if qs == "" {
+		return videos, true
+	}
+	q, err := ParseSmartQuery(qs)
+	if err != nil {
+		WriteError(w, r, err)
+		return nil, false
+	}
+	return q.Apply(videos, time.Now()), true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitQuery(t *testing.T) {
+	got := splitQuery(`tag:"周末 电影"  unwatched  name:s01`)
+	want := []string{"tag:周末 电影", "unwatched", "name:s01"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitQuery() = %q, want %q", got, want)
+	}
+}
+
+func TestSmartQuery(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	videos := []*UserVideo{
+		{Video: &Video{ID: "a", Name: "Movie 4K", Duration: 2 * time.Hour, Width: 3840, Height: 2160, Size: 20 << 30, VideoCodec: "hevc", HDR: HDR10, Added: now.Add(-2 * 24 * time.Hour)}},
+		{Video: &Video{ID: "b", Name: "Short", Duration: 5 * time.Minute, Width: 1920, Height: 1080, Size: 300 << 20, VideoCodec: "h264", Added: now.Add(-30 * 24 * time.Hour)}, Watched: true, Updated: now.Add(-time.Hour)},
+		{Video: &Video{ID: "c", Name: "Phone", Duration: 30 * time.Minute, Width: 1080, Height: 1920, Size: 1 << 30, VideoCodec: "h264", Added: now.Add(-time.Hour)}, Position: time.Minute, Favorite: true, Tags: []string{"家庭"}, Updated: now.Add(-2 * time.Hour)},
+		{Video: &Video{ID: "d", Name: "Old", Duration: 45 * time.Minute, Width: 720, Height: 480}},
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"空查询", "", []string{"a", "b", "c", "d"}},
+		{"需求中的例子", "added<7d duration>20m resolution>=4k unwatched", []string{"a"}},
+		{"竖屏按长边", "resolution>=1080p", []string{"a", "b", "c"}},
+		{"没有添加时间", "added>365d", []string{"d"}},
+		{"取反", "-watched -hdr", []string{"c", "d"}},
+		{"OR", "hdr OR favorite", []string{"a", "c"}},
+		{"标签不区分大小写", "tag:家庭", []string{"c"}},
+		{"名字包含", "name:o", []string{"a", "b", "c", "d"}},
+		{"编码", "codec:H264 size<1G", []string{"b"}},
+		{"看了一部分", "inprogress", []string{"c"}},
+		{"排序和数量", "sort:-duration limit:2", []string{"a", "d"}},
+		{"最近观看", "watched OR inprogress sort:-watched", []string{"b", "c"}},
+		{"高度", "height=480", []string{"d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := ParseSmartQuery(tt.query)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			var got []string
+			for _, v := range q.Apply(videos, now) {
+				got = append(got, v.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSmartQueryError(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"不支持的条件", "rating>3"},
+		{"不支持的文本条件", "genre:动画"},
+		{"值错误", "duration>abc"},
+		{"不支持的排序", "sort:rating"},
+		{"数量错误", "limit:0"},
+		{"OR 没有条件", "OR hdr"},
+		{"不认识的关键字", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSmartQuery(tt.query); err == nil {
+				t.Errorf("ParseSmartQuery() 应该返回错误")
+			}
+		})
+	}
+}
+
+func TestSmartStore(t *testing.T) {
+	s := newSmartStore("")
+	if _, err := s.Save("alice", SmartPlaylist{Name: "错误", Query: "rating>3"}); err == nil {
+		t.Errorf("Save() 查询错误应该返回错误")
+	}
+	p, err := s.Save("alice", SmartPlaylist{Name: " 新片 ", Query: "added<7d"})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if p.Name != "新片" || p.ID == "" {
+		t.Errorf("Save() = %+v", p)
+	}
+	p.Query = "added<14d"
+	if _, err := s.Save("alice", p); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := s.Get("bob", p.ID); ok {
+		t.Errorf("Get() 其他用户不能看到")
+	}
+	if got, _ := s.Get("alice", p.ID); got.Query != "added<14d" || !got.Created.Equal(p.Created) {
+		t.Errorf("Get() = %+v", got)
+	}
+	if _, err := s.Save("bob", p); err == nil {
+		t.Errorf("Save() 其他用户的列表应该返回错误")
+	}
+}
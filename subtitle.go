@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 字幕来源
+const (
+	SubtitleExternal = "external"
+	SubtitleEmbedded = "embedded"
+)
+
+// 支持的外部字幕扩展名
+var subtitleExts = map[string]bool{".srt": true, ".ass": true, ".ssa": true, ".vtt": true}
+
+// 可以转换成 webvtt 的内嵌文本字幕, 图形字幕不支持
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true, "webvtt": true, "mov_text": true, "text": true,
+}
+
+type Subtitle struct {
+	ID    string `json:"id"`
+	Lang  string `json:"lang"`
+	Title string `json:"title"`
+	// 外部字幕文件或者内嵌字幕流
+	Source string `json:"source"`
+	// 外部字幕的文件路径或者内嵌字幕的流序号
+	Origin string `json:"origin"`
+	// 转换后的 webvtt 文件
+	Path string `json:"path"`
+}
+
+// 查找视频旁边的字幕文件, 如 movie.srt, movie.en.srt, movie.zh-CN.forced.ass
+func FindExternalSubtitles(videoPath string) ([]*Subtitle, error) {
+	dir := filepath.Dir(videoPath)
+	stem := FileName(videoPath)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "读取字幕目录失败")
+	}
+
+	var subs []*Subtitle
+	for _, f := range files {
+		if f.IsDir() || !subtitleExts[strings.ToLower(filepath.Ext(f.Name()))] {
+			continue
+		}
+		base := FileName(f.Name())
+		sub := &Subtitle{Source: SubtitleExternal, Origin: filepath.Join(dir, f.Name())}
+		if base != stem {
+			if !strings.HasPrefix(base, stem+".") {
+				continue
+			}
+			// 第一段是语言, 剩下的作为标题
+			parts := strings.Split(base[len(stem)+1:], ".")
+			sub.Lang = parts[0]
+			sub.Title = strings.Join(parts[1:], " ")
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// 视频旁边的字幕文件和已经生成的是否不一样, 字幕文件添加, 删除或者比转换后的文件新
+func ExternalSubtitlesChanged(v *Video) (bool, error) {
+	external, err := FindExternalSubtitles(v.Path)
+	if err != nil {
+		return false, err
+	}
+	converted := map[string]string{}
+	for _, sub := range v.Subtitles {
+		if sub.Source == SubtitleExternal {
+			converted[sub.Origin] = sub.Path
+		}
+	}
+	if len(converted) != len(external) {
+		return true, nil
+	}
+	for _, sub := range external {
+		vtt, ok := converted[sub.Origin]
+		if !ok {
+			return true, nil
+		}
+		src, err := os.Stat(sub.Origin)
+		if err != nil {
+			return true, nil
+		}
+		dst, err := os.Stat(vtt)
+		if err != nil || src.ModTime().After(dst.ModTime()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 获取视频内嵌的文本字幕流
+func ProbeEmbeddedSubtitles(ffprobe, path string) ([]*Subtitle, error) {
+	cmd := exec.Command(ffprobe, "-v", "error", "-select_streams", "s", "-show_entries", "stream=index,codec_name:stream_tags=language,title", "-print_format", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, execError(cmd, err)
+	}
+
+	sj := struct {
+		Streams []struct {
+			Index     int    `json:"index"`
+			CodecName string `json:"codec_name"`
+			Tags      struct {
+				Language string `json:"language"`
+				Title    string `json:"title"`
+			} `json:"tags"`
+		} `json:"streams"`
+	}{}
+	err = json.Unmarshal(out, &sj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var subs []*Subtitle
+	for _, s := range sj.Streams {
+		if !textSubtitleCodecs[s.CodecName] {
+			continue
+		}
+		subs = append(subs, &Subtitle{
+			Lang:   s.Tags.Language,
+			Title:  s.Tags.Title,
+			Source: SubtitleEmbedded,
+			Origin: strconv.Itoa(s.Index),
+		})
+	}
+	return subs, nil
+}
+
+// 生成视频的字幕, 全部转换成 webvtt 保存在 outDir 中
+func GenSubtitles(ctx context.Context, ffprobe, ffmpeg, path, outDir string) ([]*Subtitle, error) {
+	external, err := FindExternalSubtitles(path)
+	if err != nil {
+		return nil, err
+	}
+	// 读取不了内嵌字幕时还可以使用外部字幕
+	embedded, err := ProbeEmbeddedSubtitles(ffprobe, path)
+	if err != nil {
+		fmt.Printf("内嵌字幕读取失败: %+v\n", err)
+		embedded = nil
+	}
+	if len(external)+len(embedded) <= 0 {
+		return nil, nil
+	}
+
+	err = os.MkdirAll(outDir, os.ModePerm)
+	if err != nil {
+		return nil, errors.WithMessage(err, "无法创建字幕目录")
+	}
+
+	var subs []*Subtitle
+	for i, sub := range append(external, embedded...) {
+		sub.ID = strconv.Itoa(i)
+		sub.Path = filepath.Join(outDir, sub.ID+".vtt")
+	}
+	for _, sub := range external {
+		if err := ConvertSubtitle(ctx, ffmpeg, sub.Origin, sub.Path); err != nil {
+			fmt.Printf("字幕转换失败: %+v\n", err)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	if len(embedded) > 0 {
+		if err := extractEmbeddedSubtitles(ctx, ffmpeg, path, embedded); err != nil {
+			fmt.Printf("内嵌字幕提取失败: %+v\n", err)
+		} else {
+			subs = append(subs, embedded...)
+		}
+	}
+	return subs, nil
+}
+
+// 一次提取所有的内嵌字幕流
+func extractEmbeddedSubtitles(ctx context.Context, ffmpeg, path string, subs []*Subtitle) error {
+	args := []string{"-hide_banner", "-v", "error", "-y", "-i", path}
+	for _, sub := range subs {
+		args = append(args, "-map", "0:"+sub.Origin, "-f", "webvtt", sub.Path)
+	}
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	_, err := cmd.Output()
+	if err != nil {
+		return execError(cmd, err)
+	}
+	return nil
+}
+
+// 转换字幕文件为 webvtt
+func ConvertSubtitle(ctx context.Context, ffmpeg, src, out string) error {
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".vtt":
+		return CopyFile(src, out)
+	case ".srt":
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return errors.WithMessage(err, "读取字幕失败")
+		}
+		err = ioutil.WriteFile(out, SrtToVtt(data), os.ModePerm)
+		if err != nil {
+			return errors.WithMessage(err, "写入字幕失败")
+		}
+		return nil
+	default:
+		cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-v", "error", "-y", "-i", src, "-f", "webvtt", out)
+		_, err := cmd.Output()
+		if err != nil {
+			return execError(cmd, err)
+		}
+		return nil
+	}
+}
+
+var srtTimestamp = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// srt 转 webvtt, 主要是时间戳的毫秒分隔符不同
+func SrtToVtt(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+
+	buf := bytes.NewBufferString("WEBVTT\n\n")
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.Contains(line, []byte("-->")) {
+			line = srtTimestamp.ReplaceAll(line, []byte("$1.$2"))
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// 根据id获取字幕, 不存在返回nil
+func (v *Video) Subtitle(id string) *Subtitle {
+	for _, sub := range v.Subtitles {
+		if sub.ID == id {
+			return sub
+		}
+	}
+	return nil
+}
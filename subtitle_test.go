@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSrtToVtt(t *testing.T) {
+	srt := "\xEF\xBB\xBF1\r\n00:00:01,500 --> 00:00:03,020\r\n你好, 12:00:00,000\r\n"
+	want := "WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.020\n你好, 12:00:00,000\n\n"
+	if got := string(SrtToVtt([]byte(srt))); got != want {
+		t.Errorf("SrtToVtt() = %q, want %q", got, want)
+	}
+}
+
+func TestFindExternalSubtitles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subtitle")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"movie.mkv", "movie.srt", "movie.en.srt", "movie.zh-CN.forced.ass", "movie2.srt", "movie.txt"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, os.ModePerm)
+	}
+
+	subs, err := FindExternalSubtitles(filepath.Join(dir, "movie.mkv"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	want := map[string]Subtitle{
+		"movie.en.srt":           {Lang: "en"},
+		"movie.srt":              {},
+		"movie.zh-CN.forced.ass": {Lang: "zh-CN", Title: "forced"},
+	}
+	if len(subs) != len(want) {
+		t.Fatalf("FindExternalSubtitles() got %d subtitles, want %d", len(subs), len(want))
+	}
+	for _, sub := range subs {
+		w, ok := want[filepath.Base(sub.Origin)]
+		if !ok || sub.Lang != w.Lang || sub.Title != w.Title || sub.Source != SubtitleExternal {
+			t.Errorf("FindExternalSubtitles() unexpected %+v", sub)
+		}
+	}
+}
+
+func TestExternalSubtitlesChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subtitle")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, mod time.Time) string {
+		p := filepath.Join(dir, name)
+		ioutil.WriteFile(p, []byte{}, os.ModePerm)
+		os.Chtimes(p, mod, mod)
+		return p
+	}
+	now := time.Now()
+	v := &Video{Path: write("movie.mkv", now)}
+	srt := write("movie.srt", now.Add(-time.Hour))
+	vtt := write("0.vtt", now)
+	v.Subtitles = []*Subtitle{
+		{Source: SubtitleExternal, Origin: srt, Path: vtt},
+		{Source: SubtitleEmbedded, Origin: "2", Path: filepath.Join(dir, "1.vtt")},
+	}
+
+	check := func(name string, want bool) {
+		if got, err := ExternalSubtitlesChanged(v); err != nil || got != want {
+			t.Errorf("%v: ExternalSubtitlesChanged() = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	check("没有变化", false)
+	write("movie.en.srt", now)
+	check("添加字幕", true)
+	os.Remove(filepath.Join(dir, "movie.en.srt"))
+	write("movie.srt", now.Add(time.Hour))
+	check("修改字幕", true)
+	os.Remove(srt)
+	check("删除字幕", true)
+}
+
+func TestGenSubtitlesProbeFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subtitle")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	video := filepath.Join(dir, "movie.mkv")
+	ioutil.WriteFile(video, []byte{}, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "movie.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\n你好\n"), os.ModePerm)
+
+	// 读取内嵌字幕失败时还是使用外部字幕
+	out := filepath.Join(dir, "subtitles")
+	subs, err := GenSubtitles(context.Background(), filepath.Join(dir, "no-ffprobe"), "ffmpeg", video, out)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(subs) != 1 || subs[0].Source != SubtitleExternal || !IsFileExists(subs[0].Path) {
+		t.Errorf("GenSubtitles() = %+v, want the external subtitle", subs)
+	}
+}
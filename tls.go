@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 自签名证书的有效期, 快过期时重新生成, 每天检查一次
+const (
+	selfSignedTTL     = 365 * 24 * time.Hour
+	selfSignedRenew   = 30 * 24 * time.Hour
+	selfSignedCheck   = 24 * time.Hour
+	selfSignedSubject = "night self-signed"
+)
+
+// 可以重新加载的证书, 新的连接使用新的证书, 已经建立的连接不受影响
+type CertReloader struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// 读取证书, 证书或者私钥错误时返回错误
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 重新读取证书文件, 失败时继续使用原来的证书
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.WithMessage(err, "读取证书失败")
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// 用于 tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// 缓存目录中的自签名证书, 不存在或者快过期时生成
+func EnsureSelfSignedCert(certFile, keyFile string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Add(selfSignedRenew).Before(leaf.NotAfter) {
+			return nil
+		}
+	}
+	return GenSelfSignedCert(certFile, keyFile, selfSignedHosts(), time.Now())
+}
+
+// 自签名证书包含的主机名和地址, 本机名, localhost 和所有网卡的地址
+func selfSignedHosts() []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil && name != "" && name != "localhost" {
+		hosts = append(hosts, name)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return append(hosts, "127.0.0.1", "::1")
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// 生成自签名证书, hosts 可以是主机名或者 ip
+func GenSelfSignedCert(certFile, keyFile string, hosts []string, now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: selfSignedSubject},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedTTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return errors.WithMessage(err, "生成证书失败")
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.WithMessage(err, "生成私钥失败")
+	}
+
+	if err = MkParentDir(certFile); err != nil {
+		return errors.WithMessage(err, "创建证书目录失败")
+	}
+	if err = MkParentDir(keyFile); err != nil {
+		return errors.WithMessage(err, "创建私钥目录失败")
+	}
+	// 先写临时文件再改名, 不会读到写了一半的文件, 两个都改名成功才返回 nil, 之后才能重新读取
+	// 只替换了私钥时私钥和证书不匹配, 读取失败会继续使用原来的证书, 下次检查时重新生成
+	if err = WriteFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return errors.WithMessage(err, "写入私钥失败")
+	}
+	if err = WriteFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return errors.WithMessage(err, "写入证书失败")
+	}
+	return nil
+}
+
+// 跳转到 https 的地址, 端口是 443 时省略
+func httpsURL(r *http.Request, port int) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// http 跳转到 https, 使用 308 保留请求方法
+func redirectHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, httpsURL(r, port), http.StatusPermanentRedirect)
+	})
+}
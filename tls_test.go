@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenSelfSignedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "night_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+
+	if err = GenSelfSignedCert(certFile, keyFile, []string{"localhost", "192.168.1.2", "::1"}, time.Now()); err != nil {
+		t.Fatalf("GenSelfSignedCert() error = %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"localhost", "192.168.1.2", "::1"} {
+		if err = leaf.VerifyHostname(h); err != nil {
+			t.Errorf("VerifyHostname(%v) error = %v", h, err)
+		}
+	}
+	if info, err := os.Stat(keyFile); err != nil {
+		t.Errorf("Stat() error = %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("私钥文件权限 = %v, want 0600", info.Mode().Perm())
+	}
+
+	// 没有过期的证书不会重新生成
+	if err = EnsureSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("EnsureSelfSignedCert() error = %v", err)
+	}
+	again, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	if string(again.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Errorf("EnsureSelfSignedCert() 不应该重新生成证书")
+	}
+
+	// 快过期的证书重新生成
+	if err = GenSelfSignedCert(certFile, keyFile, []string{"localhost"}, time.Now().Add(-selfSignedTTL+time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	if err = EnsureSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("EnsureSelfSignedCert() error = %v", err)
+	}
+	renewed, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	if string(renewed.Certificate[0]) == string(old.Certificate[0]) {
+		t.Errorf("EnsureSelfSignedCert() 快过期的证书应该重新生成")
+	}
+	for _, f := range []string{certFile + ".tmp", keyFile + ".tmp"} {
+		if IsFileExists(f) {
+			t.Errorf("GenSelfSignedCert() 不应该留下临时文件: %v", f)
+		}
+	}
+
+	// 证书写入失败时返回错误, 原来的证书文件不会被写坏, 下次检查时重新生成
+	os.MkdirAll(certFile+".tmp", os.ModePerm)
+	if err = GenSelfSignedCert(certFile, keyFile, []string{"localhost"}, time.Now()); err == nil {
+		t.Errorf("GenSelfSignedCert() 证书写入失败时应该返回错误")
+	}
+	if data, _ := ioutil.ReadFile(certFile); string(data) == "" {
+		t.Errorf("GenSelfSignedCert() 写入失败时不应该清空原来的证书")
+	}
+	os.RemoveAll(certFile + ".tmp")
+	if err = EnsureSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("EnsureSelfSignedCert() error = %v", err)
+	}
+	if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("EnsureSelfSignedCert() 应该重新生成匹配的证书: %v", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "night_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err = NewCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("NewCertReloader() 证书不存在应该失败")
+	}
+	if err = GenSelfSignedCert(certFile, keyFile, []string{"localhost"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader() error = %v", err)
+	}
+	first, _ := c.GetCertificate(nil)
+
+	if err = GenSelfSignedCert(certFile, keyFile, []string{"localhost"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	second, _ := c.GetCertificate(nil)
+	if string(first.Certificate[0]) == string(second.Certificate[0]) {
+		t.Errorf("Reload() 应该使用新的证书")
+	}
+
+	// 读取失败时继续使用原来的证书
+	ioutil.WriteFile(certFile, []byte("invalid"), 0644)
+	if err = c.Reload(); err == nil {
+		t.Errorf("Reload() 证书错误应该失败")
+	}
+	if cur, _ := c.GetCertificate(nil); cur != second {
+		t.Errorf("Reload() 失败后应该继续使用原来的证书")
+	}
+}
+
+func TestHttpsURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		host   string
+		port   int
+		want   string
+	}{
+		{"默认端口", "/videos/1?a=b", "example.com:8080", 443, "https://example.com/videos/1?a=b"},
+		{"其他端口", "/web", "192.168.1.2", 8443, "https://192.168.1.2:8443/web"},
+		{"ipv6", "/", "[::1]:80", 8443, "https://[::1]:8443/"},
+		{"ipv6默认端口", "/", "[::1]", 443, "https://[::1]/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(GET, tt.target, nil)
+			r.Host = tt.host
+			if got := httpsURL(r, tt.port); got != tt.want {
+				t.Errorf("httpsURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
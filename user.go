@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 会话的有效期
+const sessionTTL = 30 * 24 * time.Hour
+
+// 密码的最小长度
+const minPasswordLen = 8
+
+// 用户
+type User struct {
+	Name string `json:"name"`
+	// bcrypt 哈希后的密码
+	Password string    `json:"password"`
+	Admin    bool      `json:"admin"`
+	Created  time.Time `json:"created"`
+	// 所属的组, 用于访问控制
+	Groups []string `json:"groups"`
+	// 脚本使用的 api token
+	Tokens []*APIToken `json:"tokens"`
+}
+
+// 返回给客户端的用户信息, 不包含密码
+type UserInfo struct {
+	Name    string    `json:"name"`
+	Admin   bool      `json:"admin"`
+	Created time.Time `json:"created"`
+	Groups  []string  `json:"groups"`
+}
+
+func (u *User) Info() UserInfo {
+	groups := make([]string, len(u.Groups))
+	copy(groups, u.Groups)
+	return UserInfo{Name: u.Name, Admin: u.Admin, Created: u.Created, Groups: groups}
+}
+
+// api token, 只保存哈希, 原文只在创建时返回一次
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// 登录会话
+type Session struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+	// 是否已经解锁隐藏的库
+	Unlocked bool `json:"unlocked"`
+}
+
+// 用户信息, 和视频信息缓存放在一起
+type userStore struct {
+	mu   sync.RWMutex
+	path string
+
+	Users map[string]*User `json:"users"`
+	// token 的哈希 -> 会话
+	Sessions map[string]*Session `json:"sessions"`
+	// 访问规则
+	Rules []*AccessRule `json:"rules"`
+	// bcrypt 哈希后的隐藏库 PIN, 为空不能解锁
+	HiddenPin string `json:"hiddenPin"`
+}
+
+var users = newUserStore("")
+
+func newUserStore(path string) *userStore {
+	return &userStore{path: path, Users: map[string]*User{}, Sessions: map[string]*Session{}}
+}
+
+// 读取用户信息, 文件不存在时为空
+func LoadUsers(path string) error {
+	s := newUserStore(path)
+	if IsFileExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithMessage(err, "读取用户信息失败")
+		}
+		if err = json.Unmarshal(data, s); err != nil {
+			return errors.WithMessage(err, "解析用户信息失败")
+		}
+	}
+	users = s
+	return nil
+}
+
+// 保存用户信息, 调用时需要持有锁
+func (s *userStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	// 顺便清理过期的会话
+	now := time.Now()
+	for k, v := range s.Sessions {
+		if now.After(v.Expires) {
+			delete(s.Sessions, k)
+		}
+	}
+	// 包含密码哈希, 只有自己可以读
+	return saveJSON(s.path, s, "用户信息")
+}
+
+// 随机字符串
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 没有用户时, 比较这个哈希, 避免通过时间判断用户是否存在
+var dummyPassword, _ = bcrypt.GenerateFromPassword([]byte("goodnight"), bcrypt.DefaultCost)
+
+// 是否没有任何用户
+func (s *userStore) IsEmpty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Users) == 0
+}
+
+// 所有用户, 按名字排序
+func (s *userStore) All() []UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]UserInfo, 0, len(s.Users))
+	for _, u := range s.Users {
+		infos = append(infos, u.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// 获取用户信息, 不存在返回 false
+func (s *userStore) Get(name string) (UserInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return UserInfo{}, false
+	}
+	return u.Info(), true
+}
+
+// 创建用户
+func (s *userStore) Create(name, password string, admin bool) (UserInfo, error) {
+	if name == "" {
+		return UserInfo{}, NewError(ErrBadRequest, "用户名不能为空")
+	}
+	if len(password) < minPasswordLen {
+		return UserInfo{}, NewError(ErrBadRequest, "密码至少需要%d位", minPasswordLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return UserInfo{}, errors.WithStack(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Users[name]; ok {
+		return UserInfo{}, NewError(ErrConflict, "用户已存在: %v", name)
+	}
+	u := &User{Name: name, Password: string(hash), Admin: admin, Created: time.Now()}
+	s.Users[name] = u
+	return u.Info(), s.save()
+}
+
+// 删除用户和用户的会话
+func (s *userStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Users[name]; !ok {
+		return NewError(ErrNotFound, "用户不存在: %v", name)
+	}
+	delete(s.Users, name)
+	s.deleteSessions(name)
+	return s.save()
+}
+
+func (s *userStore) deleteSessions(name string) {
+	for k, v := range s.Sessions {
+		if v.User == name {
+			delete(s.Sessions, k)
+		}
+	}
+}
+
+// 修改密码, 已有的会话全部失效
+func (s *userStore) SetPassword(name, password string) error {
+	if len(password) < minPasswordLen {
+		return NewError(ErrBadRequest, "密码至少需要%d位", minPasswordLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return NewError(ErrNotFound, "用户不存在: %v", name)
+	}
+	u.Password = string(hash)
+	s.deleteSessions(name)
+	return s.save()
+}
+
+// 设置用户的组
+func (s *userStore) SetGroups(name string, groups []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return NewError(ErrNotFound, "用户不存在: %v", name)
+	}
+	u.Groups = groups
+	return s.save()
+}
+
+// 验证用户名和密码
+func (s *userStore) Authenticate(name, password string) (UserInfo, bool) {
+	s.mu.RLock()
+	u, ok := s.Users[name]
+	hash := dummyPassword
+	var info UserInfo
+	if ok {
+		hash = []byte(u.Password)
+		info = u.Info()
+	}
+	s.mu.RUnlock()
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return UserInfo{}, false
+	}
+	return info, true
+}
+
+// 创建会话, 返回会话的 token
+func (s *userStore) NewSession(name string) (string, *Session, error) {
+	token := randomToken(32)
+	session := &Session{User: name, Expires: time.Now().Add(sessionTTL)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sessions[hashToken(token)] = session
+	return token, session, s.save()
+}
+
+// 会话的用户, 会话不存在或过期返回 false
+func (s *userStore) SessionUser(token string) (UserInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.Sessions[hashToken(token)]
+	if !ok || time.Now().After(session.Expires) {
+		return UserInfo{}, false
+	}
+	u, ok := s.Users[session.User]
+	if !ok {
+		return UserInfo{}, false
+	}
+	return u.Info(), true
+}
+
+// 会话是否已经解锁隐藏的库
+func (s *userStore) SessionUnlocked(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.Sessions[hashToken(token)]
+	return ok && session.Unlocked
+}
+
+// 解锁或锁定会话的隐藏库
+func (s *userStore) SetSessionUnlocked(token string, unlocked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.Sessions[hashToken(token)]
+	if !ok {
+		return NewError(ErrNotFound, "会话不存在")
+	}
+	session.Unlocked = unlocked
+	return s.save()
+}
+
+// 删除会话
+func (s *userStore) DeleteSession(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Sessions, hashToken(token))
+	return s.save()
+}
+
+// 创建 api token, 返回 token 原文
+func (s *userStore) NewToken(name, tokenName string) (string, *APIToken, error) {
+	token := "night_" + randomToken(32)
+	t := &APIToken{ID: randomToken(8), Name: tokenName, Hash: hashToken(token), Created: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return "", nil, NewError(ErrNotFound, "用户不存在: %v", name)
+	}
+	u.Tokens = append(u.Tokens, t)
+	return token, t, s.save()
+}
+
+// 用户的 api token
+func (s *userStore) Tokens(name string) []APIToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return nil
+	}
+	tokens := make([]APIToken, len(u.Tokens))
+	for i, t := range u.Tokens {
+		tokens[i] = *t
+		tokens[i].Hash = ""
+	}
+	return tokens
+}
+
+// 删除 api token
+func (s *userStore) DeleteToken(name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Users[name]
+	if !ok {
+		return NewError(ErrNotFound, "用户不存在: %v", name)
+	}
+	for i, t := range u.Tokens {
+		if t.ID == id {
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return NewError(ErrNotFound, "token 不存在: %v", id)
+}
+
+// api token 的用户, 不存在返回 false
+func (s *userStore) TokenUser(token string) (UserInfo, bool) {
+	hash := []byte(hashToken(token))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.Users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 {
+				return u.Info(), true
+			}
+		}
+	}
+	return UserInfo{}, false
+}
+
+// 没有任何用户时创建管理员, 密码随机生成并打印到日志
+func (s *userStore) EnsureAdmin() error {
+	if !s.IsEmpty() {
+		return nil
+	}
+	password := randomToken(8)
+	if _, err := s.Create("admin", password, true); err != nil {
+		return err
+	}
+	log.Printf("已创建管理员 admin, 密码: %v, 请登录后修改", password)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.json")
+
+	s := newUserStore(file)
+	if _, err := s.Create("alice", "short", false); err == nil {
+		t.Errorf("Create() 密码太短应该返回错误")
+	}
+	if _, err := s.Create("alice", "password1", true); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := s.Create("alice", "password2", false); err == nil {
+		t.Errorf("Create() 用户已存在应该返回错误")
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     bool
+	}{
+		{"正确的密码", "alice", "password1", true},
+		{"错误的密码", "alice", "password2", false},
+		{"用户不存在", "bob", "password1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := s.Authenticate(tt.user, tt.password); ok != tt.want {
+				t.Errorf("Authenticate() = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+
+	session, _, err := s.NewSession("alice")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	token, apiToken, err := s.NewToken("alice", "script")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// 重新读取, 会话和 token 都还有效
+	if err := LoadUsers(file); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	s = users
+	if u, ok := s.SessionUser(session); !ok || u.Name != "alice" || !u.Admin {
+		t.Errorf("SessionUser() = %v, %v", u, ok)
+	}
+	if u, ok := s.TokenUser(token); !ok || u.Name != "alice" {
+		t.Errorf("TokenUser() = %v, %v", u, ok)
+	}
+	if tokens := s.Tokens("alice"); len(tokens) != 1 || tokens[0].Hash != "" {
+		t.Errorf("Tokens() = %v", tokens)
+	}
+
+	// 修改密码后会话失效, token 不受影响
+	if err := s.SetPassword("alice", "password3"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := s.SessionUser(session); ok {
+		t.Errorf("SessionUser() 修改密码后应该失效")
+	}
+	if err := s.DeleteToken("alice", apiToken.ID); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := s.TokenUser(token); ok {
+		t.Errorf("TokenUser() 删除后应该失效")
+	}
+}
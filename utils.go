@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // 是否是个目录, 发生错误或者不存在也返回false
@@ -59,6 +68,40 @@ func CopyFile(source, dest string) error {
 	return err
 }
 
+// 文件的临时路径, 保留扩展名, 写完后再改名
+func tempPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".tmp" + ext
+}
+
+// 先写临时文件再改名, 写到一半退出也不会损坏原来的文件
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// 把 v 保存成 json 文件, 只有自己可以读写, what 是出错时的说明, 如 "用户信息"
+func saveJSON(path string, v interface{}, what string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithMessage(err, "生成"+what+"失败")
+	}
+	if err = MkParentDir(path); err != nil {
+		return errors.WithMessage(err, "创建"+what+"失败")
+	}
+	if err = WriteFileAtomic(path, data, 0600); err != nil {
+		return errors.WithMessage(err, "写入"+what+"失败")
+	}
+	return nil
+}
+
 func MkParentDir(path string) error {
 	return os.MkdirAll(filepath.Dir(path), os.ModePerm)
 }
@@ -82,13 +125,9 @@ func Mime(path string) (string, error) {
 	return contentType, nil
 }
 
-// 是否视频文件
+// 是否视频文件, 使用默认的检测器
 func IsVideo(path string) bool {
-	mime, err := Mime(path)
-	if err != nil {
-		return false
-	}
-	return strings.Contains(mime, "video")
+	return defaultDetector.IsVideo(path)
 }
 
 func Canceled(ctx context.Context) bool {
@@ -99,3 +138,93 @@ func Canceled(ctx context.Context) bool {
 		return false
 	}
 }
+
+// 命令执行的错误, 命令执行错误时从标准错误中获取真正的错误
+func execError(cmd *exec.Cmd, err error) error {
+	if ee, ok := err.(*exec.ExitError); ok {
+		return errors.Errorf("执行错误: %s\n%s\n%s\n", cmd.String(), ee.Error(), ee.Stderr)
+	}
+	// 其他io错误
+	return errors.WithStack(err)
+}
+
+// 可读的文件大小, 如 1.5 GB
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// 格式化时长为 hh:mm:ss
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+}
+
+// 解析时间点, 支持 hh:mm:ss, mm:ss 和秒数, 秒可以带小数
+func ParseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, errors.Errorf("时间格式错误: %v", s)
+	}
+	var total float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		// 只有最后一段可以带小数
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) || (i < len(parts)-1 && v != math.Trunc(v)) {
+			return 0, errors.Errorf("时间格式错误: %v", s)
+		}
+		total = total*60 + v
+	}
+	// 超出 time.Duration 范围的也不行
+	if total*float64(time.Second) >= math.MaxInt64 {
+		return 0, errors.Errorf("时间格式错误: %v", s)
+	}
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+// 按 key 加锁, 相同的 key 互斥, 不同的 key 互不影响, 没有人使用的锁会删除
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// 锁定 key, 返回解锁的函数
+func (l *keyLocks) Lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "00:12:34", want: 12*time.Minute + 34*time.Second},
+		{s: "12:34.5", want: 12*time.Minute + 34500*time.Millisecond},
+		{s: "90", want: 90 * time.Second},
+		{s: "1.5:00", wantErr: true},
+		{s: "1:2:3:4", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "", wantErr: true},
+		{s: "NaN", wantErr: true},
+		{s: "Inf", wantErr: true},
+		{s: "1:+Inf", wantErr: true},
+		{s: "1e300", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTimestamp(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestKeyLocks(t *testing.T) {
+	var l keyLocks
+	unlockA := l.Lock("a")
+	// 不同的 key 不会等待
+	l.Lock("b")()
+
+	locked, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		unlock := l.Lock("a")
+		close(locked)
+		unlock()
+		close(done)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Lock() 相同的 key 应该等待")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	<-done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.locks) != 0 {
+		t.Errorf("没有使用的锁应该删除, 还有 %v 个", len(l.locks))
+	}
+}
+
+func TestSaveJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utils")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "data.json")
+	if err := saveJSON(path, map[string]int{"a": 1}, "测试信息"); err != nil {
+		t.Fatalf("saveJSON() error = %+v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != `{"a":1}` {
+		t.Errorf("saveJSON() 写入 %q, %v", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saveJSON() 权限应该是 0600: %v, %v", info, err)
+	}
+	if IsFileExists(path + ".tmp") {
+		t.Errorf("saveJSON() 不应该留下临时文件")
+	}
+
+	// 生成失败时不修改原来的文件
+	if err := saveJSON(path, func() {}, "测试信息"); err == nil {
+		t.Errorf("saveJSON() 应该失败")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != `{"a":1}` {
+		t.Errorf("saveJSON() 失败后文件被修改: %q", data)
+	}
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/nfnt/resize"
 	"github.com/pkg/errors"
 	"image"
 	"image/draw"
-	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"log"
@@ -18,6 +20,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,17 +29,70 @@ import (
 )
 
 type Video struct {
+	ID       string        `json:"id"`
 	Name     string        `json:"name"`
 	Path     string        `json:"path"`
 	Duration time.Duration `json:"duration"`
 	Width    int           `json:"width"`
 	Height   int           `json:"height"`
 	Preview  *VideoPreview `json:"preview"`
+	// 所在库离线或文件暂时找不到
+	Unavailable bool `json:"unavailable"`
+	// 字幕
+	Subtitles []*Subtitle `json:"subtitles"`
+	// 章节
+	Chapters []*Chapter `json:"chapters"`
+	// 文件大小
+	Size int64 `json:"size"`
+	// 视频和音频编码
+	VideoCodec string `json:"videoCodec"`
+	AudioCodec string `json:"audioCodec"`
+	// 旋转角度, 宽高已经是旋转和像素比例调整后的显示尺寸
+	Rotation int `json:"rotation"`
+	// 颜色信息, HDR 为空表示 SDR
+	ColorTransfer  string `json:"colorTransfer"`
+	ColorPrimaries string `json:"colorPrimaries"`
+	HDR            string `json:"hdr"`
+	// 第一次扫描到的时间
+	Added time.Time `json:"added"`
 }
 
-// 获取视频的信息
-func VideoInfo(ffprobe string, path string) (*Video, error) {
-	cmd := exec.Command(ffprobe, "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=height,width", "-of", "csv=s=x:p=0", "-show_format", "-print_format", "json", path)
+// 视频的id, 由路径生成
+func VideoID(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// 复制视频信息, 章节, 字幕和预览也复制, 修改副本不影响正在被读取的原视频
+func (v *Video) Clone() *Video {
+	c := *v
+	if v.Preview != nil {
+		preview := *v.Preview
+		c.Preview = &preview
+	}
+	if v.Subtitles != nil {
+		c.Subtitles = make([]*Subtitle, len(v.Subtitles))
+		for i, s := range v.Subtitles {
+			sub := *s
+			c.Subtitles[i] = &sub
+		}
+	}
+	if v.Chapters != nil {
+		c.Chapters = make([]*Chapter, len(v.Chapters))
+		for i, ch := range v.Chapters {
+			chapter := *ch
+			c.Chapters[i] = &chapter
+		}
+	}
+	return &c
+}
+
+// 获取视频的信息, 错误码为 probe_failed
+func VideoInfo(ffprobe string, path string) (_ *Video, err error) {
+	defer func() {
+		err = WrapError(err, ErrProbeFailed, "获取视频信息失败")
+	}()
+	cmd := exec.Command(ffprobe, "-v", "error", "-show_entries", "stream=codec_type,codec_name,height,width,sample_aspect_ratio,color_transfer,color_primaries:stream_disposition=attached_pic:stream_tags=rotate:stream_side_data=rotation", "-show_format", "-show_chapters", "-print_format", "json", path)
 	out, err := cmd.Output()
 
 	if err != nil {
@@ -48,17 +104,39 @@ func VideoInfo(ffprobe string, path string) (*Video, error) {
 			return nil, errors.WithStack(err)
 		}
 	}
+	return parseVideoInfo(path, out)
+}
 
+// 解析 ffprobe 输出的 json, 宽高按旋转和像素比例调整为显示尺寸
+func parseVideoInfo(path string, out []byte) (*Video, error) {
 	vfj := struct {
 		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			// 像素比例, 如 32:27
+			SampleAspectRatio string `json:"sample_aspect_ratio"`
+			ColorTransfer     string `json:"color_transfer"`
+			ColorPrimaries    string `json:"color_primaries"`
+			Disposition       struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+			// 旧版本的旋转信息在 tags 里, 新版本在 side data 里
+			Tags struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
 		} `json:"streams"`
 		Format struct {
 			Duration string `json:"duration"`
+			Size     string `json:"size"`
 		} `json:"format"`
+		Chapters []probeChapter `json:"chapters"`
 	}{}
-	err = json.Unmarshal(out, &vfj)
+	err := json.Unmarshal(out, &vfj)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -69,88 +147,275 @@ func VideoInfo(ffprobe string, path string) (*Video, error) {
 	}
 
 	video := &Video{
+		ID:       VideoID(path),
 		Name:     FileName(path),
 		Path:     path,
-		Duration: time.Millisecond * time.Duration(duration*1000),
+		Duration: seconds(duration),
+		Chapters: parseChapters(vfj.Chapters),
 	}
-	if len(vfj.Streams) > 0 {
-		video.Width = vfj.Streams[0].Width
-		video.Height = vfj.Streams[0].Height
+	video.Size, _ = strconv.ParseInt(vfj.Format.Size, 10, 64)
+	// 取第一个视频流和音频流, 封面图片不算
+	for _, s := range vfj.Streams {
+		switch {
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 0 && video.VideoCodec == "":
+			video.VideoCodec = s.CodecName
+			rotation, _ := strconv.Atoi(s.Tags.Rotate)
+			for _, sd := range s.SideDataList {
+				if sd.Rotation != 0 {
+					rotation = int(sd.Rotation)
+				}
+			}
+			video.Rotation = normalizeRotation(rotation)
+			video.Width, video.Height = DisplaySize(s.Width, s.Height, s.SampleAspectRatio, video.Rotation)
+			video.ColorTransfer = s.ColorTransfer
+			video.ColorPrimaries = s.ColorPrimaries
+			video.HDR = hdrType(s.ColorTransfer)
+		case s.CodecType == "audio" && video.AudioCodec == "":
+			video.AudioCodec = s.CodecName
+		}
 	}
 
 	return video, nil
 }
 
+// 旋转角度转换为 0, 90, 180, 270
+func normalizeRotation(rotation int) int {
+	rotation %= 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return (rotation + 45) / 90 * 90 % 360
+}
+
+// 视频的显示尺寸, 按像素比例调整宽度, 旋转90度或270度时交换宽高
+func DisplaySize(width, height int, sar string, rotation int) (int, int) {
+	var num, den int
+	if _, err := fmt.Sscanf(sar, "%d:%d", &num, &den); err == nil && num > 0 && den > 0 && num != den {
+		width = int(math.Round(float64(width) * float64(num) / float64(den)))
+	}
+	if rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return width, height
+}
+
 type VideoPreview struct {
 	Cover  string       `json:"cover"`
 	Thumbs *ThumbSprite `json:"thumbs"`
+	// 封面的来源
+	CoverSource string `json:"coverSource"`
+	// 封面的 BlurHash, 图片加载完成前的占位
+	BlurHash string `json:"blurHash"`
+	// 封面的主色, #rrggbb
+	Color string `json:"color"`
 }
 
+// 缩略图的采样方式
+const (
+	// 按固定的帧率均匀采样
+	PreviewUniform = "uniform"
+	// 按场景变化采样
+	PreviewScene = "scene"
+)
+
 type PreviewConfig struct {
 	spf, maxF, width, height, cW, cH, perW, perH int
+	// 采样方式, 默认均匀采样
+	mode string
+	// 场景变化的阈值, 0~1, 默认0.3
+	sceneThreshold float64
+	// 场景少于这个数量时改用均匀采样, 默认 maxF/4
+	minScenes int
+	// 通过管道直接读取帧, 不写临时缩略图
+	pipe bool
+	// 封面和精灵图的输出配置
+	output ImageOutput
+	// HDR 视频的色调映射过滤器, 加在采样过滤器后面
+	toneMap string
 }
 
-// 生辰视频缩略图
-func GenVideoPreview(ctx context.Context, duration time.Duration, ffmpeg, path, outDir, progressUrl string, pc PreviewConfig) (*VideoPreview, error) {
-	var fps string
-	if time.Duration(pc.spf*pc.maxF)*time.Second > duration {
-		fps = fmt.Sprintf("%d/%d", 1, pc.spf)
-	} else {
-		fps = fmt.Sprintf("%d/%d", pc.maxF, duration/time.Second)
-	}
-
+// 生辰视频缩略图, 错误码为 preview_failed
+func GenVideoPreview(ctx context.Context, duration time.Duration, ffmpeg, path, outDir, progressUrl string, pc PreviewConfig) (_ *VideoPreview, err error) {
+	defer func() {
+		err = WrapError(err, ErrPreviewFailed, "生成预览失败")
+	}()
 	thumbDir := filepath.Join(outDir, "thumbs")
-	thumbs, err := videoThumbnails(ctx, ffmpeg, path, thumbDir, fps, pc.cW, pc.cH, progressUrl)
 	// 删除所有的临时缩略图
 	defer os.RemoveAll(thumbDir)
-	if err != nil {
-		return nil, err
+
+	// 文件模式得到缩略图文件, 管道模式得到内存中的帧
+	var thumbs []string
+	var frames []image.Image
+	var times []time.Duration
+	// 返回得到的帧数, 管道模式最多在内存中保留 limit 的两倍, 0 不限制
+	grab := func(vf string, limit int) (int, error) {
+		var err error
+		var n int
+		vf = withToneMap(vf, pc.toneMap)
+		if pc.pipe {
+			frames, times, n, err = videoFramesSample(ctx, ffmpeg, path, nil, vf, pc.cW, pc.cH, limit, progressUrl)
+			return n, err
+		}
+		os.RemoveAll(thumbDir)
+		thumbs, times, err = videoThumbnailsFilter(ctx, ffmpeg, path, thumbDir, nil, vf, pc.cW, pc.cH, progressUrl)
+		return len(thumbs), err
 	}
 
-	// 复制中间图作为封面
-	cover := filepath.Join(outDir, "cover.jpg")
-	err = CopyFile(thumbs[len(thumbs)/2], cover)
+	n := 0
+	if pc.mode == PreviewScene {
+		// 按场景变化采样, 总是包含第一帧
+		threshold := pc.sceneThreshold
+		if threshold <= 0 {
+			threshold = 0.3
+		}
+		n, err = grab(fmt.Sprintf("select='eq(n,0)+gt(scene,%.3f)'", threshold), pc.maxF)
+		if err != nil {
+			return nil, err
+		}
+		minScenes := pc.minScenes
+		if minScenes <= 0 {
+			minScenes = pc.maxF / 4
+		}
+		if n < minScenes {
+			fmt.Printf("场景太少: %d, 改用均匀采样\n", n)
+			n = 0
+		} else if n > pc.maxF {
+			// 场景太多, 均匀挑选, 管道模式读取时已经均匀丢掉了一部分
+			kept := n
+			if frames != nil {
+				kept = len(frames)
+			}
+			var ps []string
+			var pf []image.Image
+			var pt []time.Duration
+			for _, i := range pickEvenly(kept, pc.maxF) {
+				if thumbs != nil {
+					ps = append(ps, thumbs[i])
+				}
+				if frames != nil {
+					pf = append(pf, frames[i])
+				}
+				if times != nil {
+					pt = append(pt, times[i])
+				}
+			}
+			thumbs, frames, times, n = ps, pf, pt, pc.maxF
+		}
+	}
+	if n == 0 {
+		var fps string
+		if time.Duration(pc.spf*pc.maxF)*time.Second > duration {
+			fps = fmt.Sprintf("%d/%d", 1, pc.spf)
+		} else {
+			fps = fmt.Sprintf("%d/%d", pc.maxF, duration/time.Second)
+		}
+		n, err = grab("fps="+fps, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n <= 0 {
+		return nil, errors.Errorf("没有生成缩略图: %v", path)
+	}
+
+	load := func(i int) (image.Image, error) {
+		if pc.pipe {
+			return frames[i], nil
+		}
+		return decodeImage(thumbs[i])
+	}
+
+	// 中间图作为封面
+	cover := filepath.Join(outDir, "cover"+pc.output.Ext())
+	img, err := load(n / 2)
+	if err == nil {
+		err = pc.output.Write(img, cover)
+	}
 	if err != nil {
 		return nil, errors.WithMessage(err, "生成封面错误")
 	}
 
-	vts, err := videoThumbnailsSprite(thumbs, filepath.Join(outDir, "thumbs.jpg"), pc.width, pc.height, pc.width/pc.perW, pc.height/pc.perH)
+	sprite := filepath.Join(outDir, "thumbs"+pc.output.Ext())
+	vts, err := composeSprite(n, func(dst draw.Image, r image.Rectangle, i int) error {
+		img, err := load(i)
+		if err != nil {
+			return errors.WithMessagef(err, "绘制缩略图错误, thumb: %d", i)
+		}
+		drawThumbImage(dst, r, img, pc.output.Filter)
+		return nil
+	}, sprite, pc.width, pc.height, pc.width/pc.perW, pc.height/pc.perH, pc.output)
 	if err != nil {
 		return nil, err
 	}
+	if len(times) >= vts.Count {
+		vts.Times = times[:vts.Count]
+	}
 
 	return &VideoPreview{
-		Cover:  cover,
-		Thumbs: vts,
+		Cover:       cover,
+		Thumbs:      vts,
+		CoverSource: CoverFrame,
 	}, nil
 }
 
+// 从 n 个中均匀挑选 max 个, 返回序号
+func pickEvenly(n, max int) []int {
+	if n <= max {
+		max = n
+	}
+	picked := make([]int, max)
+	for i := range picked {
+		picked[i] = i * n / max
+	}
+	return picked
+}
+
 // 视频缩略图
 func videoThumbnails(ctx context.Context, ffmpeg, path, thumbDir, fps string, width, height int, progressUrl string) ([]string, error) {
+	thumbs, _, err := videoThumbnailsFilter(ctx, ffmpeg, path, thumbDir, nil, "fps="+fps, width, height, progressUrl)
+	return thumbs, err
+}
+
+var showinfoPtsTime = regexp.MustCompile(`pts_time:\s*(-?[0-9.]+)`)
+
+// 使用指定的过滤器生成视频缩略图, 同时返回每张缩略图的时间点
+// inputArgs 放在输入文件前面, progressUrl 为空不报告进度
+func videoThumbnailsFilter(ctx context.Context, ffmpeg, path, thumbDir string, inputArgs []string, vf string, width, height int, progressUrl string) ([]string, []time.Duration, error) {
 	size := fmt.Sprintf("%dx%d", width, height)
 	out := filepath.Join(thumbDir, "thum%03d.jpg")
 
 	// 确保目录已创建
 	err := os.MkdirAll(thumbDir, os.ModePerm)
 	if err != nil {
-		return nil, errors.WithMessage(err, "无法创建缩略图目录")
+		return nil, nil, errors.WithMessage(err, "无法创建缩略图目录")
 	}
 
-	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-v", "error", "-progress", progressUrl, "-i", path, "-vf", "fps="+fps, "-s", size, out)
-	_, err = cmd.Output()
+	// showinfo 在 info 级别输出每一帧的时间
+	args := []string{"-hide_banner", "-nostats", "-v", "info"}
+	if progressUrl != "" {
+		args = append(args, "-progress", progressUrl)
+	}
+	args = append(args, inputArgs...)
+	args = append(args, "-i", path, "-vf", vf+",showinfo", "-vsync", "vfr", "-s", size, out)
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	times, logs := parseShowinfo(stderr.String())
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			// 命令执行错误, 从标准错误中获取真正的错误
-			return nil, errors.Errorf("执行错误: %s\n%s\n%s\n", cmd.String(), ee.Error(), ee.Stderr)
+			return nil, nil, errors.Errorf("执行错误: %s\n%s\n%s\n", cmd.String(), ee.Error(), strings.Join(logs, "\n"))
 		} else {
 			// 其他io错误
-			return nil, errors.WithStack(err)
+			return nil, nil, errors.WithStack(err)
 		}
 	}
 
 	thumbs, err := ioutil.ReadDir(thumbDir)
 	if err != nil {
-		return nil, errors.WithMessage(err, "读取缩略图失败")
+		return nil, nil, errors.WithMessage(err, "读取缩略图失败")
 	}
 
 	thumbsPaths := make([]string, len(thumbs))
@@ -161,7 +426,162 @@ func videoThumbnails(ctx context.Context, ffmpeg, path, thumbDir, fps string, wi
 	// 排序
 	sort.Strings(thumbsPaths)
 
-	return thumbsPaths, nil
+	// 时间和缩略图对不上就不要了
+	if len(times) != len(thumbsPaths) {
+		times = nil
+	}
+
+	return thumbsPaths, times, nil
+}
+
+// 通过管道从 ffmpeg 读取原始的 rgba 帧, 同时返回每一帧的时间点
+func videoFramesFilter(ctx context.Context, ffmpeg, path string, inputArgs []string, vf string, width, height int, progressUrl string) ([]image.Image, []time.Duration, error) {
+	frames, times, _, err := videoFramesSample(ctx, ffmpeg, path, inputArgs, vf, width, height, 0, progressUrl)
+	return frames, times, err
+}
+
+// 读取帧时限制保留的数量, 避免场景很多时把所有帧都放在内存中
+// 保留的帧达到 limit 的两倍时隔一帧丢一帧, 之后按两倍的间隔保留, 保留的帧在所有帧中还是均匀分布
+type frameSampler struct {
+	limit  int
+	stride int
+	frames []image.Image
+	// 保留的帧在所有帧中的序号
+	index []int
+}
+
+func newFrameSampler(limit int) *frameSampler {
+	return &frameSampler{limit: limit, stride: 1}
+}
+
+// 第 i 帧是否需要保留
+func (s *frameSampler) Keep(i int) bool {
+	return i%s.stride == 0
+}
+
+// 保留第 i 帧
+func (s *frameSampler) Add(i int, frame image.Image) {
+	s.frames = append(s.frames, frame)
+	s.index = append(s.index, i)
+	if s.limit <= 0 || len(s.frames) < s.limit*2 {
+		return
+	}
+	half := (len(s.frames) + 1) / 2
+	for j := 0; j < half; j++ {
+		s.frames[j], s.index[j] = s.frames[j*2], s.index[j*2]
+	}
+	for j := half; j < len(s.frames); j++ {
+		s.frames[j] = nil
+	}
+	s.frames, s.index = s.frames[:half], s.index[:half]
+	s.stride *= 2
+}
+
+// 和 videoFramesFilter 一样, limit 大于 0 时最多保留 limit 的两倍, 同时返回总的帧数
+func videoFramesSample(ctx context.Context, ffmpeg, path string, inputArgs []string, vf string, width, height, limit int, progressUrl string) ([]image.Image, []time.Duration, int, error) {
+	size := fmt.Sprintf("%dx%d", width, height)
+
+	args := []string{"-hide_banner", "-nostats", "-v", "info"}
+	if progressUrl != "" {
+		args = append(args, "-progress", progressUrl)
+	}
+	args = append(args, inputArgs...)
+	args = append(args, "-i", path, "-vf", vf+",showinfo", "-vsync", "vfr", "-s", size, "-f", "rawvideo", "-pix_fmt", "rgba", "pipe:1")
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, 0, errors.WithStack(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, 0, errors.WithStack(err)
+	}
+
+	sampler := newFrameSampler(limit)
+	// 不保留的帧读到这里
+	skip := make([]byte, width*height*4)
+	n := 0
+	for ; ; n++ {
+		if !sampler.Keep(n) {
+			if _, err := io.ReadFull(stdout, skip); err != nil {
+				io.Copy(ioutil.Discard, stdout)
+				break
+			}
+			continue
+		}
+		frame := image.NewRGBA(image.Rect(0, 0, width, height))
+		if _, err := io.ReadFull(stdout, frame.Pix); err != nil {
+			// 读完了, 不完整的帧丢弃
+			io.Copy(ioutil.Discard, stdout)
+			break
+		}
+		sampler.Add(n, frame)
+	}
+	err = cmd.Wait()
+
+	times, logs := parseShowinfo(stderr.String())
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			// 命令执行错误, 从标准错误中获取真正的错误
+			return nil, nil, 0, errors.Errorf("执行错误: %s\n%s\n%s\n", cmd.String(), ee.Error(), strings.Join(logs, "\n"))
+		} else {
+			// 其他io错误
+			return nil, nil, 0, errors.WithStack(err)
+		}
+	}
+
+	// 时间和帧对不上就不要了
+	if len(times) != n {
+		times = nil
+	} else {
+		kept := make([]time.Duration, len(sampler.index))
+		for i, j := range sampler.index {
+			kept[i] = times[j]
+		}
+		times = kept
+	}
+
+	return sampler.frames, times, n, nil
+}
+
+// 获取视频在某个时间点的一帧, 缩放到 width x height, toneMap 为 HDR 视频的色调映射过滤器
+func VideoFrame(ctx context.Context, ffmpeg, path string, t time.Duration, width, height int, toneMap string) (image.Image, error) {
+	args := []string{"-hide_banner", "-v", "error", "-ss", fmt.Sprintf("%.3f", t.Seconds()), "-i", path, "-frames:v", "1"}
+	if toneMap != "" {
+		args = append(args, "-vf", toneMap)
+	}
+	args = append(args, "-s", fmt.Sprintf("%dx%d", width, height), "-f", "rawvideo", "-pix_fmt", "rgba", "pipe:1")
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, execError(cmd, err)
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, width, height))
+	if len(out) < len(frame.Pix) {
+		return nil, errors.Errorf("没有获取到帧: %v, %v", path, t)
+	}
+	copy(frame.Pix, out)
+	return frame, nil
+}
+
+// 从 ffmpeg 的输出中解析 showinfo 的帧时间, 其他的输出作为日志返回
+func parseShowinfo(output string) ([]time.Duration, []string) {
+	var times []time.Duration
+	var logs []string
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, "Parsed_showinfo") {
+			logs = append(logs, line)
+			continue
+		}
+		if m := showinfoPtsTime.FindStringSubmatch(line); m != nil {
+			if t, err := strconv.ParseFloat(m[1], 64); err == nil {
+				times = append(times, seconds(t))
+			}
+		}
+	}
+	return times, logs
 }
 
 type Progress struct {
@@ -253,6 +673,11 @@ func (p *ProgressServer) Start() error {
 		defer conn.Close()
 		r := bufio.NewReader(conn)
 		prefix := ""
+		// 没有对应的进度源, 丢弃进度
+		if source == nil {
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
 		pc := &progressCollector{duration: source.Duration}
 		for {
 			line, isPrefix, err := r.ReadLine()
@@ -299,28 +724,50 @@ type ThumbSprite struct {
 	ThumbWidth  int    `json:"thumbWidth"`
 	ThumbHeight int    `json:"thumbHeight"`
 	Count       int    `json:"count"`
+	// 每张缩略图在视频中的时间点
+	Times []time.Duration `json:"times"`
 }
 
 // 生成精灵图
 func videoThumbnailsSprite(thumbs []string, out string, width, height, rows, cols int) (*ThumbSprite, error) {
+	return composeSprite(len(thumbs), func(dst draw.Image, r image.Rectangle, i int) error {
+		err := drawThumb(dst, r, thumbs[i])
+		if err != nil {
+			return errors.WithMessagef(err, "绘制缩略图错误, thumb: %v", thumbs[i])
+		}
+		return nil
+	}, out, width, height, rows, cols, ImageOutput{})
+}
+
+// 使用内存中的帧生成精灵图
+func videoFramesSprite(frames []image.Image, out string, width, height, rows, cols int) (*ThumbSprite, error) {
+	return composeSprite(len(frames), func(dst draw.Image, r image.Rectangle, i int) error {
+		drawThumbImage(dst, r, frames[i], resize.NearestNeighbor)
+		return nil
+	}, out, width, height, rows, cols, ImageOutput{})
+}
+
+// 把 count 张缩略图逐个画在精灵图上
+func composeSprite(count int, drawFn func(dst draw.Image, r image.Rectangle, i int) error, out string, width, height, rows, cols int, output ImageOutput) (*ThumbSprite, error) {
 	// 包含的缩略图数量
-	nums := int(math.Min(float64(rows*cols), float64(len(thumbs))))
+	nums := int(math.Min(float64(rows*cols), float64(count)))
 
 	// 每个缩略图的尺寸
 	thumbWidth := width / cols
 	thumbHeight := height / rows
 
-	// 生成一张背景图, 默认背景是黑的
+	// 生成一张背景图, 填充背景色
 	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(output.letterbox()), image.Point{}, draw.Src)
 
 	// 逐个把缩略图画在背景图上
 	for i := 0; i < nums; i++ {
 		col := i % cols
 		row := i / cols
 		rect := image.Rect(col*thumbWidth, row*thumbHeight, (col+1)*thumbWidth, (row+1)*thumbHeight)
-		err := drawThumb(canvas, rect, thumbs[i])
+		err := drawFn(canvas, rect, i)
 		if err != nil {
-			return nil, errors.WithMessagef(err, "绘制缩略图错误, thumb: %v", thumbs[i])
+			return nil, err
 		}
 	}
 
@@ -328,12 +775,7 @@ func videoThumbnailsSprite(thumbs []string, out string, width, height, rows, col
 	if err != nil {
 		return nil, errors.WithMessage(err, "精灵图目录创建失败")
 	}
-	f, err := os.Create(out)
-	defer f.Close()
-	if err != nil {
-		return nil, errors.WithMessagef(err, "精灵图创建失败")
-	}
-	err = jpeg.Encode(f, canvas, &jpeg.Options{Quality: 80})
+	err = output.Write(canvas, out)
 	if err != nil {
 		return nil, errors.WithMessagef(err, "精灵图写入失败")
 	}
@@ -348,25 +790,38 @@ func videoThumbnailsSprite(thumbs []string, out string, width, height, rows, col
 	}, nil
 }
 
-func drawThumb(dst draw.Image, r image.Rectangle, thumbPath string) error {
-	thumbWidth := r.Dx()
-	thumbHeight := r.Dy()
+// 读取并解码图片
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
 
-	thumb, err := os.Open(thumbPath)
+	img, _, err := image.Decode(f)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
-	defer thumb.Close()
+	return img, nil
+}
 
-	config, _, err := image.DecodeConfig(thumb)
+func drawThumb(dst draw.Image, r image.Rectangle, thumbPath string) error {
+	img, err := decodeImage(thumbPath)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	thumb.Seek(0, io.SeekStart)
+	drawThumbImage(dst, r, img, resize.NearestNeighbor)
+
+	return nil
+}
+
+func drawThumbImage(dst draw.Image, r image.Rectangle, img image.Image, filter resize.InterpolationFunction) {
+	thumbWidth := r.Dx()
+	thumbHeight := r.Dy()
 
 	// 调整原始缩略图的尺寸，适应目标位置的宽高
 	// 如果宽高小于目标，居中
-	adjustW, adjustH := AdjustAspectRatio(config.Width, config.Height, thumbWidth, thumbHeight)
+	adjustW, adjustH := AdjustAspectRatio(img.Bounds().Dx(), img.Bounds().Dy(), thumbWidth, thumbHeight)
 	var dstRect image.Rectangle
 	if thumbHeight > adjustH {
 		// 垂直居中
@@ -380,17 +835,11 @@ func drawThumb(dst draw.Image, r image.Rectangle, thumbPath string) error {
 		dstRect = r
 	}
 
-	img, _, err := image.Decode(thumb)
-	if err != nil {
-		return errors.WithStack(err)
-	}
 	// 缩放图片
-	adjustImg := resize.Resize(uint(adjustW), uint(adjustH), img, resize.NearestNeighbor)
+	adjustImg := resize.Resize(uint(adjustW), uint(adjustH), img, filter)
 
 	// 绘制
 	draw.Draw(dst, dstRect, adjustImg, image.Point{}, draw.Src)
-
-	return nil
 }
 
 func AdjustAspectRatio(width, height, tw, th int) (int, int) {
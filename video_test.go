@@ -3,6 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -127,7 +132,7 @@ func TestGenVideoThumbnail(t *testing.T) {
 
 	_, err = GenVideoPreview(context.Background(), vi.Duration, "ffmpeg", "/Users/zoukai/Downloads/ff7.mp4", "/Users/zoukai/Downloads/thumbstest",
 		ps.Addr(), PreviewConfig{
-			5, 100, 1600, 900, 412, 232, 160, 90,
+			spf: 5, maxF: 100, width: 1600, height: 900, cW: 412, cH: 232, perW: 160, perH: 90,
 		})
 
 	if err != nil {
@@ -141,3 +146,234 @@ func TestConsole(t *testing.T) {
 		fmt.Printf( "进度: %v", i)
 	}
 }
+
+func TestParseShowinfo(t *testing.T) {
+	output := `[Parsed_showinfo_1 @ 0x7f8] config in time_base: 1/1000, frame_rate: 24/1
+[Parsed_showinfo_1 @ 0x7f8] n:   0 pts:      0 pts_time:0       duration:1 fmt:yuv420p
+[Parsed_showinfo_1 @ 0x7f8] n:   1 pts:  12500 pts_time:12.5    duration:1 fmt:yuv420p
+Error while decoding stream #0:0`
+	times, logs := parseShowinfo(output)
+	if !reflect.DeepEqual(times, []time.Duration{0, 12500 * time.Millisecond}) {
+		t.Errorf("parseShowinfo() times = %v", times)
+	}
+	if !reflect.DeepEqual(logs, []string{"Error while decoding stream #0:0"}) {
+		t.Errorf("parseShowinfo() logs = %v", logs)
+	}
+}
+
+// 模拟缩略图帧
+func benchFrames(n, width, height int) []image.Image {
+	frames := make([]image.Image, n)
+	for i := range frames {
+		frame := image.NewRGBA(image.Rect(0, 0, width, height))
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i + j)
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+// 临时缩略图文件的方式: 写入 jpeg, 再读取解码生成精灵图
+func BenchmarkSpriteFromFiles(b *testing.B) {
+	dir, err := ioutil.TempDir("", "sprite")
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	frames := benchFrames(100, 412, 232)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		thumbs := make([]string, len(frames))
+		for j, frame := range frames {
+			thumbs[j] = filepath.Join(dir, fmt.Sprintf("thum%03d.jpg", j))
+			if err := (ImageOutput{}).Write(frame, thumbs[j]); err != nil {
+				b.Fatalf("%+v", err)
+			}
+		}
+		if _, err := videoThumbnailsSprite(thumbs, filepath.Join(dir, "thumbs.jpg"), 1600, 900, 10, 10); err != nil {
+			b.Fatalf("%+v", err)
+		}
+	}
+}
+
+// 管道的方式: 直接使用内存中的帧生成精灵图
+func BenchmarkSpriteFromFrames(b *testing.B) {
+	dir, err := ioutil.TempDir("", "sprite")
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	frames := benchFrames(100, 412, 232)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := videoFramesSprite(frames, filepath.Join(dir, "thumbs.jpg"), 1600, 900, 10, 10); err != nil {
+			b.Fatalf("%+v", err)
+		}
+	}
+}
+
+func benchmarkGenVideoPreview(b *testing.B, pipe bool) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		b.Skip("没有 ffmpeg")
+	}
+	dir, err := ioutil.TempDir("", "preview")
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 生成一个测试视频
+	video := filepath.Join(dir, "test.mp4")
+	cmd := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=60:size=1280x720:rate=25", video)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		b.Fatalf("%v: %s", err, out)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := GenVideoPreview(context.Background(), time.Minute, "ffmpeg", video, dir, "", PreviewConfig{
+			spf: 5, maxF: 100, width: 1600, height: 900, cW: 412, cH: 232, perW: 160, perH: 90, pipe: pipe,
+		})
+		if err != nil {
+			b.Fatalf("%+v", err)
+		}
+	}
+}
+
+func BenchmarkGenVideoPreviewFiles(b *testing.B) {
+	benchmarkGenVideoPreview(b, false)
+}
+
+func BenchmarkGenVideoPreviewPipe(b *testing.B) {
+	benchmarkGenVideoPreview(b, true)
+}
+
+func TestDisplaySize(t *testing.T) {
+	tests := []struct {
+		name           string
+		width, height  int
+		sar            string
+		rotation       int
+		wantW, wantH   int
+		coverW, coverH int
+	}{
+		{name: "竖屏", width: 1080, height: 1920, sar: "1:1", rotation: 0, wantW: 1080, wantH: 1920, coverW: 130, coverH: 232},
+		{name: "旋转90度", width: 1920, height: 1080, sar: "1:1", rotation: normalizeRotation(-90), wantW: 1080, wantH: 1920, coverW: 130, coverH: 232},
+		{name: "旋转180度", width: 1920, height: 1080, sar: "", rotation: normalizeRotation(180), wantW: 1920, wantH: 1080, coverW: 412, coverH: 231},
+		{name: "非方形像素", width: 720, height: 480, sar: "32:27", rotation: 0, wantW: 853, wantH: 480, coverW: 412, coverH: 231},
+		{name: "未知像素比例", width: 720, height: 480, sar: "0:1", rotation: 0, wantW: 720, wantH: 480, coverW: 348, coverH: 232},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := DisplaySize(tt.width, tt.height, tt.sar, tt.rotation)
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("DisplaySize() = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+			cw, ch := AdjustAspectRatio(w, h, 412, 232)
+			if cw != tt.coverW || ch != tt.coverH {
+				t.Errorf("AdjustAspectRatio() = %dx%d, want %dx%d", cw, ch, tt.coverW, tt.coverH)
+			}
+		})
+	}
+}
+
+func TestNormalizeRotation(t *testing.T) {
+	for rotation, want := range map[int]int{0: 0, 90: 90, -90: 270, -180: 180, 270: 270, 360: 0, 89: 90, -450: 270} {
+		if got := normalizeRotation(rotation); got != want {
+			t.Errorf("normalizeRotation(%d) = %d, want %d", rotation, got, want)
+		}
+	}
+}
+
+func TestParseVideoInfo(t *testing.T) {
+	probe := func(stream string) string {
+		return `{"streams": [` + stream + `, {"codec_type": "audio", "codec_name": "aac"}],
+			"format": {"duration": "60.500000", "size": "1048576"}}`
+	}
+	tests := []struct {
+		name          string
+		out           string
+		width, height int
+		rotation      int
+	}{
+		{"普通", probe(`{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "sample_aspect_ratio": "1:1"}`), 1920, 1080, 0},
+		{"side data 旋转", probe(`{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+			"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}`), 1080, 1920, 270},
+		{"tags 旋转", probe(`{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "tags": {"rotate": "90"}}`), 1080, 1920, 90},
+		{"side data 优先", probe(`{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+			"tags": {"rotate": "90"}, "side_data_list": [{"rotation": 180}]}`), 1920, 1080, 180},
+		{"非方形像素", probe(`{"codec_type": "video", "codec_name": "mpeg2video", "width": 720, "height": 480, "sample_aspect_ratio": "32:27"}`), 853, 480, 0},
+		{"像素比例和旋转", probe(`{"codec_type": "video", "codec_name": "mpeg2video", "width": 720, "height": 480, "sample_aspect_ratio": "32:27",
+			"side_data_list": [{"rotation": 90}]}`), 480, 853, 90},
+		{"跳过封面图片", `{"streams": [
+			{"codec_type": "video", "codec_name": "mjpeg", "width": 600, "height": 600, "disposition": {"attached_pic": 1}},
+			{"codec_type": "video", "codec_name": "hevc", "width": 3840, "height": 2160}],
+			"format": {"duration": "60.500000", "size": "1048576"}}`, 3840, 2160, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := parseVideoInfo("/media/a.mkv", []byte(tt.out))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if v.Width != tt.width || v.Height != tt.height || v.Rotation != tt.rotation {
+				t.Errorf("parseVideoInfo() = %dx%d %d, want %dx%d %d", v.Width, v.Height, v.Rotation, tt.width, tt.height, tt.rotation)
+			}
+			if v.Duration != 60500*time.Millisecond || v.Size != 1048576 || v.ID != VideoID("/media/a.mkv") {
+				t.Errorf("parseVideoInfo() = %+v", v)
+			}
+		})
+	}
+
+	if _, err := parseVideoInfo("/media/a.mkv", []byte(`{"format": {"duration": "N/A"}}`)); err == nil {
+		t.Errorf("parseVideoInfo() 时长错误应该返回错误")
+	}
+}
+
+func TestVideoClone(t *testing.T) {
+	v := &Video{
+		Preview:   &VideoPreview{Cover: "cover.jpg"},
+		Subtitles: []*Subtitle{{ID: "s1", Path: "s1.vtt"}},
+		Chapters:  []*Chapter{{ID: 1, Thumb: "c1.jpg"}},
+	}
+	c := v.Clone()
+	c.Preview.Cover = "new.jpg"
+	c.Subtitles[0].Path = "new.vtt"
+	c.Chapters[0].Thumb = "new.jpg"
+	if v.Preview.Cover != "cover.jpg" || v.Subtitles[0].Path != "s1.vtt" || v.Chapters[0].Thumb != "c1.jpg" {
+		t.Errorf("Clone() 修改副本影响了原视频: %+v %+v %+v", v.Preview, v.Subtitles[0], v.Chapters[0])
+	}
+}
+
+func TestFrameSampler(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		n     int
+		want  []int
+	}{
+		{"不限制", 0, 5, []int{0, 1, 2, 3, 4}},
+		{"没有超过", 3, 5, []int{0, 1, 2, 3, 4}},
+		{"超过一次", 3, 8, []int{0, 2, 4, 6}},
+		{"超过两次", 2, 13, []int{0, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFrameSampler(tt.limit)
+			for i := 0; i < tt.n; i++ {
+				if s.Keep(i) {
+					s.Add(i, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+				}
+			}
+			if !reflect.DeepEqual(s.index, tt.want) || len(s.frames) != len(tt.want) {
+				t.Errorf("index = %v, frames %d, want %v", s.index, len(s.frames), tt.want)
+			}
+			if tt.limit > 0 && len(s.frames) >= tt.limit*2 {
+				t.Errorf("保留了 %d 帧, 超过了 %d", len(s.frames), tt.limit*2)
+			}
+		})
+	}
+}
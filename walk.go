@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 文件的唯一标识, 设备号+inode, 不支持的平台使用真实路径
+type fileID struct {
+	dev, ino uint64
+	path     string
+}
+
+// 目录遍历器, 可以跟随符号链接
+// 通过文件标识检测循环, 同一个目录或文件通过多个链接到达时只访问一次
+type walker struct {
+	follow   bool
+	maxDepth int
+	dirs     map[fileID]bool
+	files    map[fileID]bool
+}
+
+// follow 是否跟随符号链接, maxDepth 最多进入几层子目录, 0 不限制
+func newWalker(follow bool, maxDepth int) *walker {
+	return &walker{
+		follow:   follow,
+		maxDepth: maxDepth,
+		dirs:     map[fileID]bool{},
+		files:    map[fileID]bool{},
+	}
+}
+
+// 遍历目录, 和 filepath.Walk 的用法一样, 根目录是链接时总是跟随
+func (w *walker) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walk(root, info, 0, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (w *walker) stat(path string) (os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err == nil && w.follow && info.Mode()&os.ModeSymlink != 0 {
+		return os.Stat(path)
+	}
+	return info, err
+}
+
+func (w *walker) walk(path string, info os.FileInfo, depth int, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		if w.follow {
+			if id, ok := fileIdentity(path, info); ok {
+				if w.files[id] {
+					return nil
+				}
+				w.files[id] = true
+			}
+		}
+		return fn(path, info, nil)
+	}
+
+	if w.maxDepth > 0 && depth > w.maxDepth {
+		return nil
+	}
+	if id, ok := fileIdentity(path, info); ok {
+		if w.dirs[id] {
+			fmt.Printf("目录已访问过, 可能是循环链接: %v, 跳过\n", path)
+			return nil
+		}
+		w.dirs[id] = true
+	}
+
+	names, err := readDirNames(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileInfo, err := w.stat(filename)
+		if err != nil {
+			if err := fn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = w.walk(filename, fileInfo, depth+1, fn)
+		if err != nil {
+			if !fileInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkerSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// root/a/deep/v2.mp4
+	// root/a/v1.mp4
+	// root/a/loop -> root
+	// root/b -> root/a
+	// root/c.mp4 -> root/a/v1.mp4
+	os.MkdirAll(filepath.Join(root, "a", "deep"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "a", "v1.mp4"), []byte{}, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "a", "deep", "v2.mp4"), []byte{}, os.ModePerm)
+	if err := os.Symlink(root, filepath.Join(root, "a", "loop")); err != nil {
+		t.Skipf("不支持符号链接: %v", err)
+	}
+	os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "b"))
+	os.Symlink(filepath.Join(root, "a", "v1.mp4"), filepath.Join(root, "c.mp4"))
+
+	files := func(w *walker) []string {
+		var got []string
+		w.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(root, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		return got
+	}
+
+	tests := []struct {
+		name   string
+		walker *walker
+		want   []string
+	}{
+		{name: "不跟随", walker: newWalker(false, 0), want: []string{"a/deep/v2.mp4", "a/loop", "a/v1.mp4", "b", "c.mp4"}},
+		{name: "跟随并去重", walker: newWalker(true, 0), want: []string{"a/deep/v2.mp4", "a/v1.mp4"}},
+		{name: "最大深度", walker: newWalker(true, 1), want: []string{"a/v1.mp4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := files(tt.walker); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Walk() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}